@@ -0,0 +1,207 @@
+package bkl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// A Cache holds parsed files and the merged state of shared base layers so
+// that Parsers rendering many files with common ancestors parse and merge
+// each ancestor once. Files are identified by path and content, so changes
+// on disk are picked up. A Cache is safe for concurrent use by multiple
+// Parsers; see [Parser.SetCache].
+type Cache struct {
+	mu     sync.Mutex
+	files  map[string][]cachedDoc
+	merges map[string]*snapshot
+}
+
+// cachedDoc is a parsed and normalized document, before $env is applied.
+type cachedDoc struct {
+	data      any
+	positions positions
+	comments  comments
+}
+
+// A snapshot is the result of merging a sequence of files with
+// MergeFileLayers: the documents, and the documents of each of the files,
+// which later files in the sequence link to as parents. key identifies the
+// sequence (see layerKeys).
+type snapshot struct {
+	key   string
+	docs  []*Document
+	files [][]*Document
+}
+
+// NewCache creates and returns an empty [Cache].
+func NewCache() *Cache {
+	return &Cache{
+		files:  map[string][]cachedDoc{},
+		merges: map[string]*snapshot{},
+	}
+}
+
+// SetCache sets the cache used to reuse parsed files and merged base layers
+// across Parsers. A nil cache (the default) disables caching.
+func (p *Parser) SetCache(c *Cache) {
+	p.cache = c
+}
+
+func (c *Cache) getFile(key string) ([]cachedDoc, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	docs, found := c.files[key]
+	if !found {
+		return nil, false
+	}
+
+	ret := make([]cachedDoc, len(docs))
+
+	for i, doc := range docs {
+		ret[i] = cachedDoc{
+			data:      deepCopy(doc.data),
+			positions: doc.positions.clone(),
+			comments:  doc.comments.clone(),
+		}
+	}
+
+	return ret, true
+}
+
+func (c *Cache) putFile(key string, docs []cachedDoc) {
+	if c == nil {
+		return
+	}
+
+	stored := make([]cachedDoc, len(docs))
+
+	for i, doc := range docs {
+		stored[i] = cachedDoc{
+			data:      deepCopy(doc.data),
+			positions: doc.positions.clone(),
+			comments:  doc.comments.clone(),
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.files[key] = stored
+}
+
+// getMerge returns a copy of the snapshot stored for key.
+func (c *Cache) getMerge(key string) *snapshot {
+	if c == nil || key == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	snap := c.merges[key]
+	c.mu.Unlock()
+
+	if snap == nil {
+		return nil
+	}
+
+	return snap.clone(map[*Document]*Document{})
+}
+
+func (c *Cache) hasMerge(key string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, found := c.merges[key]
+
+	return found
+}
+
+// putMerge stores snap, which must not be modified afterwards.
+func (c *Cache) putMerge(snap *snapshot) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.merges[snap.key] = snap
+}
+
+// clone returns a deep copy of snap. m maps original documents to their
+// copies and is updated, so that documents shared with other copies made
+// with the same m are copied once.
+func (snap *snapshot) clone(m map[*Document]*Document) *snapshot {
+	ret := &snapshot{
+		key:   snap.key,
+		docs:  cloneDocuments(snap.docs, m),
+		files: make([][]*Document, len(snap.files)),
+	}
+
+	for i, docs := range snap.files {
+		ret.files[i] = cloneDocuments(docs, m)
+	}
+
+	return ret
+}
+
+// fileCacheKey identifies the contents of a file for the parse cache.
+func fileCacheKey(format, path, hash string) string {
+	return fmt.Sprintf("%s\x00%s\x00%s", format, path, hash)
+}
+
+func contentHash(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// layerKeys returns a key for each prefix of files, as returned by
+// loadFileAndParents, identifying the path, content, $env values and $file
+// contents of each file and how their documents link to each other, and
+// whether p records provenance and source order. Merging two sequences with
+// the same key produces the same documents. The key is "" for prefixes that
+// include virtual files, which can't be identified.
+func (p *Parser) layerKeys(files []*file) []string {
+	keys := make([]string, len(files))
+	index := map[*Document]string{}
+	h := sha256.New()
+
+	fmt.Fprintf(h, "provenance=%t sourceOrder=%t\n", p.provenance, p.sourceOrder)
+
+	for i, f := range files {
+		if f.virtual {
+			break
+		}
+
+		fmt.Fprintf(h, "%q %q %q %q\n", f.path, f.hash, f.envKey, f.includeKey)
+
+		for j, doc := range f.docs {
+			index[doc] = fmt.Sprintf("%d.%d", i, j)
+
+			for _, parent := range doc.Parents {
+				parentIndex, found := index[parent]
+				if !found {
+					return keys
+				}
+
+				fmt.Fprintf(h, "%s ", parentIndex)
+			}
+
+			fmt.Fprintln(h)
+		}
+
+		keys[i] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	return keys
+}
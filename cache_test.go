@@ -0,0 +1,181 @@
+package bkl_test
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gopatchy/bkl"
+	"github.com/stretchr/testify/require"
+)
+
+// copyFixture copies tests/<name> to a temporary directory, for tests that
+// modify files, and returns its path.
+func copyFixture(t *testing.T, name string) string {
+	dir := t.TempDir()
+	src := filepath.Join("tests", name)
+
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dir, rel), 0o700)
+		}
+
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		return os.WriteFile(filepath.Join(dir, rel), raw, 0o600)
+	})
+	require.NoError(t, err)
+
+	return dir
+}
+
+func renderWith(t *testing.T, b *bkl.Parser) (string, string) {
+	out, err := b.Output("json")
+	require.NoError(t, err)
+
+	blame := &bytes.Buffer{}
+	require.NoError(t, b.Blame(blame))
+
+	return string(out), blame.String()
+}
+
+func renderLayers(t *testing.T, cache *bkl.Cache, env map[string]string, path string) (string, string) {
+	b := bkl.New()
+	b.SetEnvMap(env)
+	b.SetCache(cache)
+	b.SetProvenance(true)
+	require.NoError(t, b.MergeFileLayers(path))
+
+	return renderWith(t, b)
+}
+
+func TestClone(t *testing.T) {
+	t.Parallel()
+
+	env := map[string]string{"NAME": "n"}
+
+	base := bkl.New()
+	base.SetEnvMap(env)
+	base.SetProvenance(true)
+	require.NoError(t, base.MergeFileLayers("tests/cache/a.b.yaml"))
+
+	wantBase, _ := renderWith(t, base)
+
+	for _, path := range []string{"tests/cache/a.b.c.yaml", "tests/cache/a.b.d.yaml"} {
+		b := base.Clone()
+		require.NoError(t, b.MergeFileLayers(path))
+
+		out, blame := renderWith(t, b)
+		wantOut, wantBlame := renderLayers(t, nil, env, path)
+		require.Equal(t, wantOut, out, path)
+		require.Equal(t, wantBlame, blame, path)
+		require.Len(t, b.Documents(), 2, path)
+	}
+
+	out, _ := renderWith(t, base)
+	require.Equal(t, wantBase, out)
+}
+
+func TestCache(t *testing.T) {
+	t.Parallel()
+
+	dir := copyFixture(t, "cache")
+	paths := []string{filepath.Join(dir, "a.b.c.yaml"), filepath.Join(dir, "a.b.d.yaml")}
+	cache := bkl.NewCache()
+	env := map[string]string{"NAME": "n"}
+
+	want := map[string][2]string{}
+
+	for _, path := range paths {
+		out, blame := renderLayers(t, nil, env, path)
+		want[path] = [2]string{out, blame}
+	}
+
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(path string) {
+			defer wg.Done()
+
+			out, blame := renderLayers(t, cache, env, path)
+			require.Equal(t, want[path], [2]string{out, blame}, path)
+		}(paths[i%2])
+	}
+
+	wg.Wait()
+
+	// Merges cached without provenance aren't reused when recording it
+	noProv := bkl.NewCache()
+
+	b := bkl.New()
+	b.SetCache(noProv)
+	require.NoError(t, b.MergeFileLayers("tests/cache-provenance/a.b.c.yaml"))
+
+	b = bkl.New()
+	b.SetCache(noProv)
+	b.SetProvenance(true)
+	require.NoError(t, b.MergeFileLayers("tests/cache-provenance/a.b.c.yaml"))
+
+	src, err := b.Provenance(1, "y")
+	require.NoError(t, err)
+	require.Equal(t, bkl.Source{Position: bkl.Position{File: "tests/cache-provenance/a.b.yaml", Line: 2, Column: 1}}, src)
+
+	// $env values and file contents are part of the cache key
+	out, _ := renderLayers(t, cache, map[string]string{"NAME": "m"}, paths[0])
+	require.Contains(t, out, `"name":"m"`)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.yaml"), []byte("name: z\nl: [a]\n---\nx: 1\n"), 0o600))
+	out, _ = renderLayers(t, cache, env, paths[0])
+	require.Contains(t, out, `"name":"z"`)
+	require.Contains(t, out, `"l":["a","b","c"]`)
+
+	// So are the contents of imported files and their $env values
+	dir = copyFixture(t, "cache-import")
+	path := filepath.Join(dir, "a.b.yaml")
+
+	out, _ = renderLayers(t, cache, env, path)
+	require.Equal(t, `{"x":{"n":"n","v":1},"y":2}`+"\n", out)
+
+	out, _ = renderLayers(t, cache, map[string]string{"NAME": "m"}, path)
+	require.Equal(t, `{"x":{"n":"m","v":1},"y":2}`+"\n", out)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "lib.yaml"), []byte("v: \"1\"\nn: $env:NAME\n"), 0o600))
+	out, _ = renderLayers(t, cache, env, path)
+	require.Equal(t, `{"x":{"n":"n","v":"1"},"y":2}`+"\n", out)
+}
+
+func TestMergeFileLayersRepeat(t *testing.T) {
+	t.Parallel()
+
+	for _, cache := range []*bkl.Cache{nil, bkl.NewCache()} {
+		b := bkl.New()
+		b.SetCache(cache)
+		require.NoError(t, b.MergeFileLayers("tests/merge-layers-repeat/a.yaml"))
+		require.NoError(t, b.MergeFileLayers("tests/merge-layers-repeat/a.b.yaml"))
+
+		out, err := b.Output("json")
+		require.NoError(t, err)
+		require.Equal(t, `{"a":1}
+{"b":2}
+{"a":1,"c":3}
+{"b":2,"c":3}
+`, string(out))
+	}
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync"
 
 	"github.com/gopatchy/bkl"
 	"github.com/jessevdk/go-flags"
@@ -12,26 +15,95 @@ import (
 )
 
 type options struct {
-	OutputPath   *flags.Filename `short:"o" long:"output" description:"output file path"`
-	OutputFormat *string         `short:"f" long:"format" description:"output format" choice:"json" choice:"json-pretty" choice:"toml" choice:"yaml"`
-	SkipParent   bool            `short:"P" long:"skip-parent" description:"skip loading parent templates"`
-	Verbose      bool            `short:"v" long:"verbose" description:"enable verbose logging"`
-	Version      bool            `short:"V" long:"version" description:"print version and exit"`
+	OutputPath   *flags.Filename  `short:"o" long:"output" description:"output file path"`
+	EnvFiles     []flags.Filename `long:"env-file" description:"read $env variables from dotenv file instead of the environment (repeatable)"`
+	OutputFormat *string          `short:"f" long:"format" description:"output format"`
+	SkipParent   bool             `short:"P" long:"skip-parent" description:"skip loading parent templates"`
+	KeyOrder     string           `long:"key-order" choice:"sorted" choice:"source" default:"sorted" description:"order of map keys in output"`
+	Deps         bool             `long:"deps" description:"print the paths of all files read instead of output"`
+	DepFile      *flags.Filename  `short:"M" long:"depfile" description:"also write a make/ninja depfile for the output path"`
+	Verbose      bool             `short:"v" long:"verbose" description:"enable verbose logging"`
+	Version      bool             `short:"V" long:"version" description:"print version and exit"`
 
 	Positional struct {
 		InputPaths []flags.Filename `positional-arg-name:"inputPath" required:"0" description:"input file path"`
 	} `positional-args:"yes"`
 }
 
+type blameOptions struct {
+	SkipParent bool `short:"P" long:"skip-parent" description:"skip loading parent templates"`
+	Verbose    bool `short:"v" long:"verbose" description:"enable verbose logging"`
+
+	Positional struct {
+		InputPaths []flags.Filename `positional-arg-name:"inputPath" required:"1" description:"input file path"`
+	} `positional-args:"yes"`
+}
+
+type renderOptions struct {
+	OutDir       flags.Filename   `long:"out-dir" required:"yes" description:"output directory"`
+	EnvFiles     []flags.Filename `long:"env-file" description:"read $env variables from dotenv file instead of the environment (repeatable)"`
+	OutputFormat *string          `short:"f" long:"format" description:"output format (default: format of each input file)"`
+	KeyOrder     string           `long:"key-order" choice:"sorted" choice:"source" default:"sorted" description:"order of map keys in output"`
+	Jobs         int              `short:"j" long:"jobs" description:"number of files to render in parallel (default: number of CPUs)"`
+	Verbose      bool             `short:"v" long:"verbose" description:"enable verbose logging"`
+
+	Positional struct {
+		InputDirs []flags.Filename `positional-arg-name:"inputDir" required:"1" description:"input directory"`
+	} `positional-args:"yes"`
+}
+
+type affectedOptions struct {
+	Root flags.Filename `long:"root" required:"yes" description:"directory containing leaf layers"`
+
+	Positional struct {
+		ChangedPaths []flags.Filename `positional-arg-name:"changedPath" required:"1" description:"changed file path"`
+	} `positional-args:"yes"`
+}
+
+type graphOptions struct {
+	DOT bool `long:"dot" description:"output Graphviz DOT instead of a text tree"`
+
+	Positional struct {
+		InputPaths []flags.Filename `positional-arg-name:"inputPath" required:"1" description:"input file or directory path"`
+	} `positional-args:"yes"`
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "blame":
+			blame(os.Args[2:])
+			return
+
+		case "render":
+			render(os.Args[2:])
+			return
+
+		case "affected":
+			affected(os.Args[2:])
+			return
+
+		case "graph":
+			graph(os.Args[2:])
+			return
+		}
+	}
+
 	opts := &options{}
 
 	fp := flags.NewParser(opts, flags.Default)
+	fp.FindOptionByLongName("format").Choices = bkl.Formats()
 	fp.LongDescription = `
 bkl interprets layered configuration files from YAML, JSON, and TOML with additional bkl syntax.
 
 See https://bkl.gopatchy.io/ for detailed documentation.
 
+Subcommands:
+* bkl blame: print each output value with the layer that set it
+* bkl render: render every leaf layer in a directory tree
+* bkl affected: list leaf layers that inherit from changed files
+* bkl graph: show how layers inherit from each other
+
 Related tools:
 * bklb
 * bkld
@@ -53,11 +125,21 @@ Related tools:
 	}
 
 	p := bkl.New()
+	p.SetSourceOrder(opts.KeyOrder == "source")
 
 	if opts.Verbose {
 		p.SetDebug(true)
 	}
 
+	if len(opts.EnvFiles) > 0 {
+		env, err := readEnvFiles(opts.EnvFiles)
+		if err != nil {
+			fatal(err)
+		}
+
+		p.SetEnvMap(env)
+	}
+
 	format := ""
 	if opts.OutputFormat != nil {
 		format = *opts.OutputFormat
@@ -84,6 +166,25 @@ Related tools:
 		}
 	}
 
+	if opts.Deps {
+		for _, path := range p.Files() {
+			fmt.Println(path)
+		}
+
+		return
+	}
+
+	if opts.DepFile != nil {
+		if opts.OutputPath == nil {
+			fatal(fmt.Errorf("--depfile requires --output")) //nolint:goerr113
+		}
+
+		err = writeDepFile(string(*opts.DepFile), string(*opts.OutputPath), p.Files())
+		if err != nil {
+			fatal(err)
+		}
+	}
+
 	if opts.OutputPath == nil {
 		err = p.OutputToWriter(os.Stdout, format)
 	} else {
@@ -95,6 +196,299 @@ Related tools:
 	}
 }
 
+func blame(args []string) {
+	opts := &blameOptions{}
+
+	fp := flags.NewParser(opts, flags.Default)
+	fp.Usage = "blame [OPTIONS] inputPath..."
+	fp.LongDescription = `
+bkl blame prints every leaf value of the merged and processed documents, annotated with the file and position of the layer that last set it.`
+
+	_, err := fp.ParseArgs(args)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	p := bkl.New()
+	p.SetProvenance(true)
+
+	if opts.Verbose {
+		p.SetDebug(true)
+	}
+
+	for _, path := range opts.Positional.InputPaths {
+		realPath, _, err := bkl.FileMatch(string(path))
+		if err != nil {
+			fatal(err)
+		}
+
+		if opts.SkipParent {
+			err = p.MergeFile(realPath)
+		} else {
+			err = p.MergeFileLayers(realPath)
+		}
+
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	err = p.Blame(os.Stdout)
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func render(args []string) {
+	opts := &renderOptions{}
+
+	fp := flags.NewParser(opts, flags.Default)
+	fp.Usage = "render [OPTIONS] inputDir..."
+	fp.FindOptionByLongName("format").Choices = bkl.Formats()
+	fp.LongDescription = `
+bkl render finds every leaf layer (a file that no other file uses as a parent or reads with $import or $file) in the input directories, renders each with its parents, and writes the results to the same relative paths under the output directory. All failures are reported at the end.`
+
+	_, err := fp.ParseArgs(args)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	var env map[string]string
+
+	if len(opts.EnvFiles) > 0 {
+		env, err = readEnvFiles(opts.EnvFiles)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	format := ""
+	if opts.OutputFormat != nil {
+		format = *opts.OutputFormat
+	}
+
+	jobs := opts.Jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	type job struct {
+		inPath  string
+		outPath string
+		format  string
+	}
+
+	queue := []job{}
+	scanErrs := []error{}
+
+	for _, dir := range opts.Positional.InputDirs {
+		leaves, errs, err := bkl.New().ScanLeaves(string(dir))
+		if err != nil {
+			fatal(err)
+		}
+
+		scanErrs = append(scanErrs, errs...)
+
+		for _, leaf := range leaves {
+			rel, err := filepath.Rel(string(dir), leaf)
+			if err != nil {
+				fatal(err)
+			}
+
+			outFormat := format
+			if outFormat == "" {
+				outFormat = strings.TrimPrefix(filepath.Ext(leaf), ".")
+			}
+
+			ext := outFormat
+			if ext2, found := renderExtensions[outFormat]; found {
+				ext = ext2
+			}
+
+			queue = append(queue, job{
+				inPath:  leaf,
+				outPath: filepath.Join(string(opts.OutDir), strings.TrimSuffix(rel, filepath.Ext(rel))+"."+ext),
+				format:  outFormat,
+			})
+		}
+	}
+
+	cache := bkl.NewCache()
+	errs := make([]error, len(queue))
+	sem := make(chan struct{}, jobs)
+	wg := sync.WaitGroup{}
+
+	for i, j := range queue {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, j job) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			p := bkl.New()
+			p.SetCache(cache)
+			p.SetSourceOrder(opts.KeyOrder == "source")
+
+			if opts.Verbose {
+				p.SetDebug(true)
+			}
+
+			if env != nil {
+				p.SetEnvMap(env)
+			}
+
+			errs[i] = renderFile(p, j.inPath, j.outPath, j.format)
+		}(i, j)
+	}
+
+	wg.Wait()
+
+	failed := 0
+
+	for _, err := range append(scanErrs, errs...) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		fatal(fmt.Errorf("%d of %d files failed to render", failed, len(scanErrs)+len(queue))) //nolint:goerr113
+	}
+}
+
+func affected(args []string) {
+	opts := &affectedOptions{}
+
+	fp := flags.NewParser(opts, flags.Default)
+	fp.Usage = "affected [OPTIONS] changedPath..."
+	fp.LongDescription = `
+bkl affected prints every leaf layer (a file that no other file uses as a parent or reads with $import or $file) in the root directory that is, inherits from, or reads with $file or $import any of the changed files.`
+
+	_, err := fp.ParseArgs(args)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	changed := []string{}
+
+	for _, path := range opts.Positional.ChangedPaths {
+		changed = append(changed, string(path))
+	}
+
+	leaves, err := bkl.New().Affected(string(opts.Root), changed...)
+	if err != nil {
+		fatal(err)
+	}
+
+	for _, leaf := range leaves {
+		fmt.Println(leaf)
+	}
+}
+
+func graph(args []string) {
+	opts := &graphOptions{}
+
+	fp := flags.NewParser(opts, flags.Default)
+	fp.Usage = "graph [OPTIONS] inputPath..."
+	fp.LongDescription = `
+bkl graph prints the inheritance graph of the input files, the files in input directories, and all of their parents. Each link is labelled with why it exists: filename, $parent, glob or symlink.`
+
+	_, err := fp.ParseArgs(args)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	paths := []string{}
+
+	for _, path := range opts.Positional.InputPaths {
+		paths = append(paths, string(path))
+	}
+
+	g, err := bkl.New().Graph(paths...)
+	if err != nil {
+		fatal(err)
+	}
+
+	if opts.DOT {
+		err = g.WriteDOT(os.Stdout)
+	} else {
+		err = g.WriteTree(os.Stdout)
+	}
+
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// renderExtensions maps output formats to the extensions of the files bkl
+// render writes them to, where those differ.
+var renderExtensions = map[string]string{
+	"json-pretty": "json",
+}
+
+// renderFile writes the output of inPath and its parents to outPath, in
+// format. Nothing is written on failure.
+func renderFile(p *bkl.Parser, inPath, outPath, format string) error {
+	err := p.MergeFileLayers(inPath)
+	if err != nil {
+		return err
+	}
+
+	out, err := p.Output(format)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(outPath), 0o755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(outPath, out, 0o644)
+}
+
+// writeDepFile writes a depfile in the format read by make and ninja, listing
+// deps as the prerequisites of target.
+func writeDepFile(path, target string, deps []string) error {
+	b := &strings.Builder{}
+	b.WriteString(escapeDep(target))
+	b.WriteString(":")
+
+	for _, dep := range deps {
+		b.WriteString(" \\\n  ")
+		b.WriteString(escapeDep(dep))
+	}
+
+	b.WriteString("\n")
+
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
+
+func escapeDep(path string) string {
+	return strings.NewReplacer(" ", "\\ ", "#", "\\#", "$", "$$").Replace(path)
+}
+
+func readEnvFiles(paths []flags.Filename) (map[string]string, error) {
+	env := map[string]string{}
+
+	for _, path := range paths {
+		vars, err := bkl.ReadEnvFile(string(path))
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range vars {
+			env[k] = v
+		}
+	}
+
+	return env, nil
+}
+
 func version() {
 	bi, ok := debug.ReadBuildInfo()
 	if !ok {
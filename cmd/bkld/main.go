@@ -13,7 +13,7 @@ import (
 
 type options struct {
 	OutputPath   *flags.Filename `short:"o" long:"output" description:"output file path"`
-	OutputFormat *string         `short:"f" long:"format" description:"output format" choice:"json" choice:"json-pretty" choice:"toml" choice:"yaml"`
+	OutputFormat *string         `short:"f" long:"format" description:"output format"`
 
 	Positional struct {
 		BasePath   flags.Filename `positional-arg-name:"basePath" required:"true" description:"base layer file path"`
@@ -35,6 +35,7 @@ func main() {
 	opts := &options{}
 
 	fp := flags.NewParser(opts, flags.Default)
+	fp.FindOptionByLongName("format").Choices = bkl.Formats()
 	fp.LongDescription = `
 bkld generates the minimal intermediate layer needed to create the target output from the base layer.
 
@@ -13,7 +13,7 @@ import (
 
 type options struct {
 	OutputPath   *flags.Filename `short:"o" long:"output" description:"output file path"`
-	OutputFormat *string         `short:"f" long:"format" description:"output format" choice:"json" choice:"json-pretty" choice:"toml" choice:"yaml"`
+	OutputFormat *string         `short:"f" long:"format" description:"output format"`
 
 	Positional struct {
 		InputPath flags.Filename `positional-arg-name:"layerPath" required:"true" description:"lower layer file path"`
@@ -34,6 +34,7 @@ func main() {
 	opts := &options{}
 
 	fp := flags.NewParser(opts, flags.Default)
+	fp.FindOptionByLongName("format").Choices = bkl.Formats()
 	fp.LongDescription = `
 bklr generates a document containing just the required fields and their ancestors from the lower layer.
 
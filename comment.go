@@ -0,0 +1,128 @@
+package bkl
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A comment holds the comments attached to a key in a YAML layer, as
+// returned by yaml.v3: each is one or more "#" lines, or "".
+type comment struct {
+	head string
+	line string
+	foot string
+}
+
+// comments maps key paths within a document (e.g. "a.b[2].c", or "" for
+// comments on the document itself) to their comments.
+type comments map[string]comment
+
+func (c comment) isZero() bool {
+	return c == comment{}
+}
+
+// text returns the comment lines of c without their "#" markers, head
+// comment first.
+func (c comment) text() string {
+	lines := []string{}
+
+	for _, part := range []string{c.head, c.line, c.foot} {
+		if part == "" {
+			continue
+		}
+
+		for _, line := range strings.Split(part, "\n") {
+			line = strings.TrimPrefix(strings.TrimSpace(line), "#")
+			lines = append(lines, strings.TrimPrefix(line, " "))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (cs comments) clone() comments {
+	if cs == nil {
+		return nil
+	}
+
+	ret := make(comments, len(cs))
+
+	for path, c := range cs {
+		ret[path] = c
+	}
+
+	return ret
+}
+
+// remap translates the paths in cs, which are relative to patchData, to the
+// paths that the same keys will have once patchData is merged into dstData.
+// It must be called before merging, since merging modifies both.
+func (cs comments) remap(dstData, patchData any) comments {
+	ret := comments{}
+
+	for path, c := range cs {
+		if path != "" {
+			path = remapPath(path, dstData, patchData)
+			if path == "" {
+				continue
+			}
+		}
+
+		ret[path] = c
+	}
+
+	return ret
+}
+
+// merge replaces the comments in cs with those for the same paths in other,
+// which come from a higher layer.
+func (cs comments) merge(other comments) {
+	for path, c := range other {
+		cs[path] = c
+	}
+}
+
+func yamlComments(node *yaml.Node, path string, cs comments) {
+	switch node.Kind { //nolint:exhaustive
+	case yaml.DocumentNode:
+		if c := (comment{head: node.HeadComment, foot: node.FootComment}); !c.isZero() {
+			cs[path] = c
+		}
+
+		for _, child := range node.Content {
+			yamlComments(child, path, cs)
+		}
+
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			k, v := node.Content[i], node.Content[i+1]
+			subPath := keyPath(path, k.Value)
+
+			c := comment{
+				head: k.HeadComment,
+				line: k.LineComment,
+				foot: k.FootComment,
+			}
+
+			if c.line == "" {
+				c.line = v.LineComment
+			}
+
+			if c.foot == "" {
+				c.foot = v.FootComment
+			}
+
+			if !c.isZero() {
+				cs[subPath] = c
+			}
+
+			yamlComments(v, subPath, cs)
+		}
+
+	case yaml.SequenceNode:
+		for i, v := range node.Content {
+			yamlComments(v, indexPath(path, i), cs)
+		}
+	}
+}
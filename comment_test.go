@@ -0,0 +1,26 @@
+package bkl_test
+
+import (
+	"testing"
+
+	"github.com/gopatchy/bkl"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComments(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	require.NoError(t, b.MergeFileLayers("tests/comments-list/a.b.yaml"))
+
+	out, err := b.Output("toml")
+	require.NoError(t, err)
+	require.Contains(t, string(out), "# head a\n# line a\na = 1\n")
+	require.Contains(t, string(out), "# line c\nc = 'z'\n")
+
+	out, err = b.Output("json")
+	require.NoError(t, err)
+	require.Equal(t, `{"a":1,"b":{"c":"z","d":[]},"e":[{"f":1},{"g":2}]}
+`, string(out))
+}
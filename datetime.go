@@ -0,0 +1,158 @@
+package bkl
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// A DateTime is a date, a time of day, or both, with or without a time zone
+// offset, as found in TOML dates and times and YAML timestamps. Layers keep
+// them as DateTimes rather than strings so that each output format writes
+// them natively: as a TOML date or time, as a YAML timestamp, or as an RFC
+// 3339 string in JSON.
+type DateTime struct {
+	// Time is the date and time. Parts that aren't present are zero, and
+	// the location is UTC unless HasZone is set.
+	Time time.Time
+
+	HasDate bool
+	HasTime bool
+	HasZone bool
+}
+
+const (
+	dateLayout = "2006-01-02"
+	timeLayout = "15:04:05.999999999"
+)
+
+// parseDateTime parses an RFC 3339 date, time of day, date and time, or date
+// and time with offset. The date and time may also be separated by "t" or a
+// space, as allowed by TOML and YAML.
+func parseDateTime(s string) (DateTime, error) {
+	if len(s) > len(dateLayout) {
+		switch s[len(dateLayout)] {
+		case 't', ' ':
+			s = s[:len(dateLayout)] + "T" + s[len(dateLayout)+1:]
+		}
+	}
+
+	if strings.HasSuffix(s, "z") {
+		s = s[:len(s)-1] + "Z"
+	}
+
+	layouts := []DateTime{
+		{HasDate: true},
+		{HasTime: true},
+		{HasDate: true, HasTime: true},
+		{HasDate: true, HasTime: true, HasZone: true},
+	}
+
+	var err error
+
+	for _, dt := range layouts {
+		var t time.Time
+
+		t, err = time.Parse(dt.layout(), s)
+		if err == nil {
+			dt.Time = t
+			return dt, nil
+		}
+	}
+
+	return DateTime{}, err
+}
+
+func newDateTime(t time.Time) DateTime {
+	return DateTime{
+		Time:    t,
+		HasDate: true,
+		HasTime: true,
+		HasZone: true,
+	}
+}
+
+func (dt DateTime) layout() string {
+	switch {
+	case dt.HasZone:
+		return time.RFC3339Nano
+	case dt.HasDate && dt.HasTime:
+		return dateLayout + "T" + timeLayout
+	case dt.HasDate:
+		return dateLayout
+	default:
+		return timeLayout
+	}
+}
+
+// String returns dt in RFC 3339 format, with only the parts that are present.
+func (dt DateTime) String() string {
+	return dt.Time.Format(dt.layout())
+}
+
+// Equal returns whether dt and other have the same parts and represent the
+// same instant (or local date and time) with the same offset.
+func (dt DateTime) Equal(other DateTime) bool {
+	_, offset := dt.Time.Zone()
+	_, otherOffset := other.Time.Zone()
+
+	return dt.HasDate == other.HasDate &&
+		dt.HasTime == other.HasTime &&
+		dt.HasZone == other.HasZone &&
+		offset == otherOffset &&
+		dt.Time.Equal(other.Time)
+}
+
+func (dt DateTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(dt.String())
+}
+
+func (dt DateTime) MarshalYAML() (any, error) {
+	if !dt.HasDate {
+		// YAML timestamps always have a date
+		return dt.String(), nil
+	}
+
+	value := dt.String()
+
+	if !dt.HasZone {
+		// YAML only recognizes local date and times separated by a space
+		value = strings.Replace(value, "T", " ", 1)
+	}
+
+	return &yaml.Node{
+		Kind:  yaml.ScalarNode,
+		Tag:   "!!timestamp",
+		Value: value,
+	}, nil
+}
+
+// toml returns dt as the TOML encoder's type for its parts.
+func (dt DateTime) toml() any {
+	date := toml.LocalDate{
+		Year:  dt.Time.Year(),
+		Month: int(dt.Time.Month()),
+		Day:   dt.Time.Day(),
+	}
+
+	tod := toml.LocalTime{
+		Hour:       dt.Time.Hour(),
+		Minute:     dt.Time.Minute(),
+		Second:     dt.Time.Second(),
+		Nanosecond: dt.Time.Nanosecond(),
+	}
+
+	switch {
+	case dt.HasZone:
+		return dt.Time
+	case dt.HasDate && dt.HasTime:
+		return toml.LocalDateTime{LocalDate: date, LocalTime: tod}
+	case dt.HasDate:
+		return date
+	default:
+		return tod
+	}
+}
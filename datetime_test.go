@@ -0,0 +1,50 @@
+package bkl_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gopatchy/bkl"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNumbersAndDateTimes(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	require.NoError(t, b.MergeFileLayers("tests/datetime-match/a.b.toml"))
+
+	out, err := b.Output("json")
+	require.NoError(t, err)
+	require.Equal(t, `{"id":1234567890123456789,"when":"2001-12-14T21:59:43Z"}
+{"id":2,"name":"second","when":"2001-12-14"}
+`, string(out))
+
+	type doc struct {
+		ID   int64     `bkl:"id"`
+		When time.Time `bkl:"when"`
+		Name string    `bkl:"name"`
+	}
+
+	var docs []doc
+	require.NoError(t, b.Decode(&docs))
+	require.Equal(t, int64(1234567890123456789), docs[0].ID)
+	require.True(t, docs[0].When.Equal(time.Date(2001, 12, 14, 21, 59, 43, 0, time.UTC)))
+
+	b = bkl.New()
+	require.ErrorIs(t, b.MergeFileLayers("tests/datetime-match/a.c.json"), bkl.ErrUselessOverride)
+}
+
+func TestNumberOutOfRange(t *testing.T) {
+	t.Parallel()
+
+	for _, path := range []string{"huge.json", "large.yaml"} {
+		b := bkl.New()
+
+		err := b.MergeFileLayers("tests/number-precision/" + path)
+		require.ErrorIs(t, err, bkl.ErrInvalidType, path)
+		require.ErrorContains(t, err, path+":1:", path)
+		require.ErrorContains(t, err, ": 12345678901234567890123: integer out of range", path)
+	}
+}
@@ -0,0 +1,427 @@
+package bkl
+
+import (
+	"encoding"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Decode processes all documents and stores the output in the value pointed
+// to by v.
+//
+// If there is exactly one output document, it is decoded into v. Otherwise v
+// must point to a slice, and each output document is decoded into one
+// element.
+//
+// Struct fields are matched to keys using the "bkl" struct tag, falling back
+// to the "json" tag and then to a case-insensitive match on the field name.
+// Keys that don't match any field are an error ([ErrExtraKeys]), as are values
+// that can't be stored in the destination type ([ErrInvalidType]). Both are
+// returned as an [*Error] with the full key path.
+func (p *Parser) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("decode into %T: %w", v, ErrInvalidArguments)
+	}
+
+	outs, err := p.OutputDocuments()
+	if err != nil {
+		return err
+	}
+
+	dst := rv.Elem()
+
+	if len(outs) == 1 && !isDocumentList(dst, outs[0]) {
+		err = decodeValue(outs[0], dst)
+		if err != nil {
+			return withDocument(err, "", 0)
+		}
+
+		return nil
+	}
+
+	if dst.Kind() != reflect.Slice {
+		return fmt.Errorf("decode %d documents into %s: %w", len(outs), dst.Type(), ErrInvalidArguments)
+	}
+
+	docs := reflect.MakeSlice(dst.Type(), len(outs), len(outs))
+
+	for i, out := range outs {
+		err = decodeValue(out, docs.Index(i))
+		if err != nil {
+			return withDocument(err, "", i)
+		}
+	}
+
+	dst.Set(docs)
+
+	return nil
+}
+
+// Load merges the layers for the file at path and decodes the output into a
+// new T. See [Parser.Decode] for decoding rules.
+func Load[T any](path string) (T, error) {
+	var ret T
+
+	p := New()
+
+	err := p.MergeFileLayers(path)
+	if err != nil {
+		return ret, err
+	}
+
+	err = p.Decode(&ret)
+	if err != nil {
+		return ret, err
+	}
+
+	return ret, nil
+}
+
+// isDocumentList returns whether dst is a slice that should receive each
+// document as an element, rather than the contents of a single list document.
+func isDocumentList(dst reflect.Value, out any) bool {
+	if dst.Kind() != reflect.Slice {
+		return false
+	}
+
+	_, isList := out.([]any)
+
+	return !isList
+}
+
+var (
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	timeType            = reflect.TypeOf(time.Time{})
+)
+
+func decodeValue(src any, dst reflect.Value) error {
+	if src == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	srcVal := reflect.ValueOf(src)
+
+	if srcVal.Type().AssignableTo(dst.Type()) {
+		dst.Set(srcVal)
+		return nil
+	}
+
+	if dst.Kind() == reflect.Pointer {
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+
+		return decodeValue(src, dst.Elem())
+	}
+
+	if dt, ok := src.(DateTime); ok && dst.Type() == timeType {
+		dst.Set(reflect.ValueOf(dt.Time))
+		return nil
+	}
+
+	if str, ok := src.(string); ok && reflect.PointerTo(dst.Type()).Implements(textUnmarshalerType) {
+		err := dst.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(str))
+		if err != nil {
+			return fmt.Errorf("%s: %w", err, ErrInvalidType) //nolint:errorlint
+		}
+
+		return nil
+	}
+
+	switch dst.Kind() { //nolint:exhaustive
+	case reflect.Struct:
+		return decodeStruct(src, dst)
+
+	case reflect.Map:
+		return decodeMap(src, dst)
+
+	case reflect.Slice:
+		return decodeSlice(src, dst)
+
+	case reflect.Array:
+		return decodeArray(src, dst)
+
+	case reflect.String:
+		str, ok := src.(string)
+		if !ok {
+			return decodeMismatch(src, dst)
+		}
+
+		dst.SetString(str)
+
+	case reflect.Bool:
+		b, ok := src.(bool)
+		if !ok {
+			return decodeMismatch(src, dst)
+		}
+
+		dst.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := toInt64(src)
+		if !ok || dst.OverflowInt(i) {
+			return decodeMismatch(src, dst)
+		}
+
+		dst.SetInt(i)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, ok := toUint64(src)
+		if !ok || dst.OverflowUint(u) {
+			return decodeMismatch(src, dst)
+		}
+
+		dst.SetUint(u)
+
+	case reflect.Float32, reflect.Float64:
+		f, ok := toFloat(src)
+		if !ok || dst.OverflowFloat(f) {
+			return decodeMismatch(src, dst)
+		}
+
+		dst.SetFloat(f)
+
+	default:
+		return decodeMismatch(src, dst)
+	}
+
+	return nil
+}
+
+func decodeStruct(src any, dst reflect.Value) error {
+	srcMap, ok := src.(map[string]any)
+	if !ok {
+		return decodeMismatch(src, dst)
+	}
+
+	fields := structFields(dst.Type())
+
+	for k, v := range srcMap {
+		index, found := fields[k]
+		if !found {
+			index, found = fields[strings.ToLower(k)]
+		}
+
+		if !found {
+			return withKey(fmt.Errorf("no field in %s: %w", dst.Type(), ErrExtraKeys), k)
+		}
+
+		field, err := fieldByIndex(dst, index)
+		if err != nil {
+			return withKey(err, k)
+		}
+
+		err = decodeValue(v, field)
+		if err != nil {
+			return withKey(err, k)
+		}
+	}
+
+	return nil
+}
+
+// structFields returns the field index for each key that t accepts. Keys from
+// field names are also registered in lower case for case-insensitive matches.
+func structFields(t reflect.Type) map[string][]int {
+	ret := map[string][]int{}
+	lower := map[string][]int{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		name, tagged := fieldName(field)
+		if name == "-" {
+			continue
+		}
+
+		if field.Anonymous && !tagged {
+			ft := field.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+
+			if ft.Kind() == reflect.Struct {
+				for k, index := range structFields(ft) {
+					if _, found := ret[k]; !found {
+						ret[k] = append([]int{i}, index...)
+					}
+				}
+
+				continue
+			}
+		}
+
+		if !field.IsExported() {
+			continue
+		}
+
+		ret[name] = []int{i}
+
+		if !tagged {
+			lower[strings.ToLower(name)] = []int{i}
+		}
+	}
+
+	for k, index := range lower {
+		if _, found := ret[k]; !found {
+			ret[k] = index
+		}
+	}
+
+	return ret
+}
+
+func fieldName(field reflect.StructField) (string, bool) {
+	for _, tag := range []string{"bkl", "json"} {
+		val, found := field.Tag.Lookup(tag)
+		if !found {
+			continue
+		}
+
+		name := strings.Split(val, ",")[0]
+		if name != "" {
+			return name, true
+		}
+	}
+
+	return field.Name, false
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex but allocates nil embedded
+// struct pointers.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("nil embedded pointer to unexported %s: %w", v.Type().Elem(), ErrInvalidType)
+				}
+
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+
+			v = v.Elem()
+		}
+
+		v = v.Field(x)
+	}
+
+	return v, nil
+}
+
+func decodeMap(src any, dst reflect.Value) error {
+	srcMap, ok := src.(map[string]any)
+	if !ok || dst.Type().Key().Kind() != reflect.String {
+		return decodeMismatch(src, dst)
+	}
+
+	if dst.IsNil() {
+		dst.Set(reflect.MakeMapWithSize(dst.Type(), len(srcMap)))
+	}
+
+	for k, v := range srcMap {
+		val := reflect.New(dst.Type().Elem()).Elem()
+
+		err := decodeValue(v, val)
+		if err != nil {
+			return withKey(err, k)
+		}
+
+		dst.SetMapIndex(reflect.ValueOf(k).Convert(dst.Type().Key()), val)
+	}
+
+	return nil
+}
+
+func decodeSlice(src any, dst reflect.Value) error {
+	srcList, ok := src.([]any)
+	if !ok {
+		return decodeMismatch(src, dst)
+	}
+
+	ret := reflect.MakeSlice(dst.Type(), len(srcList), len(srcList))
+
+	for i, v := range srcList {
+		err := decodeValue(v, ret.Index(i))
+		if err != nil {
+			return withIndex(err, i)
+		}
+	}
+
+	dst.Set(ret)
+
+	return nil
+}
+
+func decodeArray(src any, dst reflect.Value) error {
+	srcList, ok := src.([]any)
+	if !ok || len(srcList) != dst.Len() {
+		return decodeMismatch(src, dst)
+	}
+
+	for i, v := range srcList {
+		err := decodeValue(v, dst.Index(i))
+		if err != nil {
+			return withIndex(err, i)
+		}
+	}
+
+	return nil
+}
+
+func decodeMismatch(src any, dst reflect.Value) error {
+	return fmt.Errorf("decode %T into %s: %w", src, dst.Type(), ErrInvalidType)
+}
+
+func toFloat(v any) (float64, bool) {
+	switch v2 := v.(type) {
+	case int:
+		return float64(v2), true
+	case int64:
+		return float64(v2), true
+	case uint64:
+		return float64(v2), true
+	case float64:
+		return v2, true
+	default:
+		return 0, false
+	}
+}
+
+// toInt64 returns the number v as an int64 if it's an integer in range.
+func toInt64(v any) (int64, bool) {
+	switch v2 := v.(type) {
+	case int:
+		return int64(v2), true
+	case int64:
+		return v2, true
+	case uint64:
+		return int64(v2), v2 <= math.MaxInt64
+	case float64:
+		return int64(v2), v2 == math.Trunc(v2) && v2 >= math.MinInt64 && v2 < math.MaxInt64
+	default:
+		return 0, false
+	}
+}
+
+// toUint64 returns the number v as a uint64 if it's a non-negative integer in
+// range.
+func toUint64(v any) (uint64, bool) {
+	switch v2 := v.(type) {
+	case int:
+		return uint64(v2), v2 >= 0
+	case int64:
+		return uint64(v2), v2 >= 0
+	case uint64:
+		return v2, true
+	case float64:
+		return uint64(v2), v2 == math.Trunc(v2) && v2 >= 0 && v2 < math.MaxUint64
+	default:
+		return 0, false
+	}
+}
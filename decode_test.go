@@ -0,0 +1,81 @@
+package bkl_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/gopatchy/bkl"
+	"github.com/stretchr/testify/require"
+)
+
+func ExampleLoad() {
+	type Service struct {
+		Name string `bkl:"name"`
+		Addr string `json:"addr"`
+		Port int
+	}
+
+	// Also parses tests/example1/a.yaml
+	svc, err := bkl.Load[Service]("tests/example1/a.b.toml")
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("%+v\n", svc)
+	// Output:
+	// {Name:myService Addr:127.0.0.1 Port:8081}
+}
+
+func TestDecodeDocuments(t *testing.T) {
+	t.Parallel()
+
+	type doc struct {
+		A int      `bkl:"a"`
+		B []string `bkl:"b"`
+	}
+
+	b := bkl.New()
+
+	require.NoError(t, b.MergeFileLayers("tests/decode-documents/a.yaml"))
+
+	var docs []doc
+	require.NoError(t, b.Decode(&docs))
+	require.Equal(t, []doc{{A: 1, B: []string{"x"}}, {A: 2}}, docs)
+
+	var one doc
+	require.ErrorIs(t, b.Decode(&one), bkl.ErrInvalidArguments)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	t.Parallel()
+
+	type inner struct {
+		C int `json:"c"`
+	}
+
+	type doc struct {
+		A map[string][]inner `bkl:"a"`
+	}
+
+	for _, tc := range []struct {
+		path     string
+		sentinel error
+		keyPath  string
+	}{
+		{"type.yaml", bkl.ErrInvalidType, "a.b[1].c"},
+		{"extra.yaml", bkl.ErrExtraKeys, "a.b[0].d"},
+	} {
+		b := bkl.New()
+
+		require.NoError(t, b.MergeFileLayers("tests/decode-errors/"+tc.path))
+
+		var d doc
+		err := b.Decode(&d)
+		require.ErrorIs(t, err, tc.sentinel, tc.path)
+
+		var e *bkl.Error
+		require.True(t, errors.As(err, &e), tc.path)
+		require.Equal(t, tc.keyPath, e.Path, tc.path)
+	}
+}
@@ -0,0 +1,204 @@
+package bkl
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gopatchy/bkl/polyfill"
+)
+
+// A Directive implements a custom $<name> directive, run during output
+// processing alongside the built-in directives. Any of the functions may be
+// nil, in which case the directive isn't recognized in that position.
+//
+// mergeFrom is the document being output and mergeFromDocs are all documents,
+// as used by $merge and $replace to resolve references. Values returned by
+// Map, List and String are processed further, so they may contain other
+// directives.
+type Directive struct {
+	// Map is called for maps containing the key $<name>. obj is the map
+	// without that key and v is its value.
+	Map func(obj map[string]any, v any, mergeFrom *Document, mergeFromDocs []*Document) (any, error)
+
+	// List is called for lists containing the entry {$<name>: v}. obj is the
+	// list without that entry.
+	List func(obj []any, v any, mergeFrom *Document, mergeFromDocs []*Document) (any, error)
+
+	// String is called for strings of the form $<name> or $<name>:<arg>.
+	String func(arg string, mergeFrom *Document, mergeFromDocs []*Document) (any, error)
+}
+
+// An Encoder implements a custom $encode:<name> operation. obj has already
+// been processed. args are the colon-separated arguments following the name,
+// e.g. ["a", "b"] for $encode:<name>:a:b. The returned value is output as-is.
+type Encoder func(obj any, args []string, mergeFrom *Document, mergeFromDocs []*Document) (any, error)
+
+var (
+	pluginMu          sync.RWMutex
+	directiveByName   = map[string]Directive{}
+	encoderByName     = map[string]Encoder{}
+	builtinDirectives = []string{"delete", "encode", "env", "file", "import", "interp", "match", "merge", "output", "parent", "replace", "required", "value"}
+	builtinEncoders   = []string{"base64", "flags", "flatten", "join", "prefix", "tolist"}
+)
+
+// RegisterDirective makes $<name> available as a directive. name must not
+// include the leading $. Strings matching a registered directive with a
+// String func are not rejected as invalid directives in output.
+//
+// RegisterDirective panics if name is a built-in directive.
+func RegisterDirective(name string, d Directive) {
+	if polyfill.SlicesContains(builtinDirectives, name) {
+		panic(fmt.Sprintf("bkl: RegisterDirective $%s: built-in directive", name))
+	}
+
+	pluginMu.Lock()
+	defer pluginMu.Unlock()
+
+	directiveByName[name] = d
+}
+
+// RegisterEncoder makes $encode:<name> available. Registered encoders take
+// precedence over formats of the same name.
+//
+// RegisterEncoder panics if name is a built-in $encode operation.
+func RegisterEncoder(name string, e Encoder) {
+	if polyfill.SlicesContains(builtinEncoders, name) {
+		panic(fmt.Sprintf("bkl: RegisterEncoder %s: built-in $encode operation", name))
+	}
+
+	pluginMu.Lock()
+	defer pluginMu.Unlock()
+
+	encoderByName[name] = e
+}
+
+func getDirective(name string) (Directive, bool) {
+	pluginMu.RLock()
+	defer pluginMu.RUnlock()
+
+	d, found := directiveByName[name]
+
+	return d, found
+}
+
+// directiveNames returns the names of registered directives, sorted so that
+// maps and lists with several of them are processed deterministically.
+func directiveNames() []string {
+	pluginMu.RLock()
+	defer pluginMu.RUnlock()
+
+	names := polyfill.MapsKeys(directiveByName)
+	polyfill.SlicesSort(names)
+
+	return names
+}
+
+func getEncoder(name string) (Encoder, bool) {
+	pluginMu.RLock()
+	defer pluginMu.RUnlock()
+
+	e, found := encoderByName[name]
+
+	return e, found
+}
+
+// stringDirectiveName returns the directive name in strings of the form
+// $<name> or $<name>:<arg>.
+func stringDirectiveName(obj string) (string, string, bool) {
+	if !strings.HasPrefix(obj, "$") {
+		return "", "", false
+	}
+
+	name, arg, _ := strings.Cut(strings.TrimPrefix(obj, "$"), ":")
+
+	return name, arg, true
+}
+
+func processMapDirectives(obj map[string]any, mergeFrom *Document, mergeFromDocs []*Document, depth int, rec *recorder, path string) (bool, any, error) {
+	for _, name := range directiveNames() {
+		d, _ := getDirective(name)
+		if d.Map == nil {
+			continue
+		}
+
+		k := "$" + name
+
+		found, v, obj := popMapValue(obj, k)
+		if !found {
+			continue
+		}
+
+		next, err := d.Map(obj, v, mergeFrom, mergeFromDocs)
+		if err != nil {
+			return true, nil, withKey(err, k)
+		}
+
+		rec.remove(keyPath(path, k))
+		rec.fill(path, next)
+
+		ret, err := process(next, mergeFrom, mergeFromDocs, depth, rec, path)
+
+		return true, ret, err
+	}
+
+	return false, nil, nil
+}
+
+func processListDirectives(obj []any, mergeFrom *Document, mergeFromDocs []*Document, depth int, rec *recorder, path string) (bool, any, error) {
+	for _, name := range directiveNames() {
+		d, _ := getDirective(name)
+		if d.List == nil {
+			continue
+		}
+
+		k := "$" + name
+
+		rec.filterListMapValue(path, obj, k)
+
+		v, obj, err := popListMapValue(obj, k)
+		if err != nil {
+			return true, nil, err
+		}
+
+		if v == nil {
+			continue
+		}
+
+		next, err := d.List(obj, v, mergeFrom, mergeFromDocs)
+		if err != nil {
+			return true, nil, withDirective(err, k)
+		}
+
+		rec.fill(path, next)
+
+		ret, err := process(next, mergeFrom, mergeFromDocs, depth, rec, path)
+
+		return true, ret, err
+	}
+
+	return false, nil, nil
+}
+
+func processStringDirective(obj string, mergeFrom *Document, mergeFromDocs []*Document, depth int, rec *recorder, path string) (bool, any, error) {
+	name, arg, ok := stringDirectiveName(obj)
+	if !ok {
+		return false, nil, nil
+	}
+
+	d, found := getDirective(name)
+	if !found || d.String == nil {
+		return false, nil, nil
+	}
+
+	next, err := d.String(arg, mergeFrom, mergeFromDocs)
+	if err != nil {
+		return true, nil, withDirective(err, "$"+name)
+	}
+
+	rec.fill(path, next)
+
+	ret, err := process(next, mergeFrom, mergeFromDocs, depth, rec, path)
+
+	return true, ret, err
+}
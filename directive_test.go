@@ -0,0 +1,82 @@
+package bkl_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gopatchy/bkl"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterDirective(t *testing.T) {
+	t.Parallel()
+
+	bkl.RegisterDirective("testsidecar", bkl.Directive{
+		Map: func(obj map[string]any, v any, mergeFrom *bkl.Document, mergeFromDocs []*bkl.Document) (any, error) {
+			obj["sidecar"] = map[string]any{
+				"image": v,
+				"port":  "$merge:port",
+			}
+
+			return obj, nil
+		},
+		List: func(obj []any, v any, mergeFrom *bkl.Document, mergeFromDocs []*bkl.Document) (any, error) {
+			return append(obj, fmt.Sprintf("sidecar:%v", v)), nil
+		},
+		String: func(arg string, mergeFrom *bkl.Document, mergeFromDocs []*bkl.Document) (any, error) {
+			return strings.ToUpper(arg), nil
+		},
+	})
+
+	bkl.RegisterEncoder("testrepeat", func(obj any, args []string, mergeFrom *bkl.Document, mergeFromDocs []*bkl.Document) (any, error) {
+		return strings.Repeat(fmt.Sprintf("%v", obj), len(args)+1), nil
+	})
+
+	b := bkl.New()
+
+	require.NoError(t, b.MergeFileLayers("tests/directive-plugin/a.yaml"))
+
+	blob, err := b.Output("json")
+	require.NoError(t, err)
+	require.Equal(t, `{"app":{"name":"APP","sidecar":{"image":"envoy","port":8080}},"enc":"xxx","list":["a","sidecar:envoy"],"port":8080}
+`, string(blob))
+
+	require.Panics(t, func() { bkl.RegisterDirective("merge", bkl.Directive{}) })
+	require.Panics(t, func() { bkl.RegisterDirective("file", bkl.Directive{}) })
+	require.Panics(t, func() { bkl.RegisterDirective("import", bkl.Directive{}) })
+}
+
+func TestRegisterDirectiveWithoutString(t *testing.T) {
+	t.Parallel()
+
+	bkl.RegisterDirective("testmaponly", bkl.Directive{
+		Map: func(obj map[string]any, v any, mergeFrom *bkl.Document, mergeFromDocs []*bkl.Document) (any, error) {
+			return obj, nil
+		},
+	})
+
+	b := bkl.New()
+
+	require.NoError(t, b.MergeFileLayers("tests/directive-string-unset/a.yaml"))
+
+	_, err := b.Output("json")
+	require.ErrorIs(t, err, bkl.ErrInvalidDirective)
+}
+
+func TestRegisterDirectiveKey(t *testing.T) {
+	t.Parallel()
+
+	bkl.RegisterDirective("testkey", bkl.Directive{
+		String: func(arg string, mergeFrom *bkl.Document, mergeFromDocs []*bkl.Document) (any, error) {
+			return arg, nil
+		},
+	})
+
+	b := bkl.New()
+
+	require.NoError(t, b.MergeFileLayers("tests/directive-plugin-key/a.yaml"))
+
+	_, err := b.Output("json")
+	require.ErrorIs(t, err, bkl.ErrInvalidDirective)
+}
@@ -16,11 +16,34 @@ type Document struct {
 	ID      DocID
 	Parents []*Document
 	Data    any
+
+	// positions records the source locations of key paths in Data from every
+	// layer merged into this document.
+	positions positions
+
+	// origin is the file and document index this document was loaded from.
+	origin Source
+
+	// provenance records the layer that last set each key path in Data, if
+	// the Parser records provenance.
+	provenance *provenance
+
+	// keys records the source order of the keys of each map in Data.
+	keys *keyOrder
+
+	// comments records the comments attached to key paths in Data, from the
+	// highest layer that has any for each path.
+	comments comments
+
+	// imports holds the documents of files loaded by $import in any layer
+	// merged into this document, for references.
+	imports imports
 }
 
 func NewDocument() *Document {
 	return &Document{
-		ID: typeid.Must(typeid.New[DocID]()),
+		ID:        typeid.Must(typeid.New[DocID]()),
+		positions: positions{},
 	}
 }
 
@@ -74,6 +97,68 @@ func (d *Document) PopMapValue(key string) (bool, any) {
 	return found, val
 }
 
+// clone returns a copy of d with its own copy of Data.
+func (d *Document) clone() *Document {
+	ret := *d
+	ret.Data = deepCopy(d.Data)
+	ret.imports = d.imports.clone()
+
+	return &ret
+}
+
+// cloneDocuments returns deep copies of docs, including their Data,
+// positions, provenance, key order, comments and the documents they link to
+// as parents. m maps original documents to their copies and is updated, so
+// that documents reachable several ways are copied once and links between
+// copies are preserved. IDs are preserved.
+func cloneDocuments(docs []*Document, m map[*Document]*Document) []*Document {
+	ret := make([]*Document, len(docs))
+
+	for i, doc := range docs {
+		ret[i] = doc.cloneLinked(m)
+	}
+
+	return ret
+}
+
+func (d *Document) cloneLinked(m map[*Document]*Document) *Document {
+	if ret, found := m[d]; found {
+		return ret
+	}
+
+	ret := d.clone()
+	m[d] = ret
+
+	ret.positions = d.positions.clone()
+
+	if d.provenance != nil {
+		ret.provenance = d.provenance.clone()
+	}
+
+	if d.keys != nil {
+		ret.keys = d.keys.clone()
+	}
+
+	ret.comments = d.comments.clone()
+
+	if d.Parents != nil {
+		ret.Parents = cloneDocuments(d.Parents, m)
+	}
+
+	return ret
+}
+
+// sourceAt returns the Source for path in this document as loaded.
+func (d *Document) sourceAt(path string) Source {
+	src := d.origin
+
+	if poss := d.positions[path]; len(poss) > 0 {
+		src.Position = poss[len(poss)-1]
+	}
+
+	return src
+}
+
 func (d *Document) String() string {
 	return d.ID.String()
 }
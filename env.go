@@ -1,63 +1,442 @@
 package bkl
 
 import (
+	"bufio"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+
+	"github.com/gopatchy/bkl/polyfill"
 )
 
-func env(obj any) (any, error) {
+// An envSource provides the variables for $env.
+type envSource struct {
+	lookup func(string) (string, bool)
+
+	// names lists the variables for prefix matches, or is nil if they
+	// can't be listed.
+	names func() []string
+}
+
+func env(obj any, src envSource) (any, error) {
 	switch obj2 := obj.(type) {
 	case map[string]any:
-		return envMap(obj2)
+		if _, found := obj2["$env"]; found {
+			ret, err := envValue(obj2, src)
+			if err != nil {
+				return nil, withDirective(err, "$env")
+			}
+
+			return ret, nil
+		}
+
+		return envMap(obj2, src)
 
 	case []any:
-		return envList(obj2)
+		return envList(obj2, src)
 
 	case string:
-		return envString(obj2)
+		return envString(obj2, src)
 
 	default:
 		return obj2, nil
 	}
 }
 
-func envMap(obj map[string]any) (map[string]any, error) {
+func envMap(obj map[string]any, src envSource) (map[string]any, error) {
 	return filterMap(obj, func(k string, v any) (map[string]any, error) {
-		k, err := envString(k)
+		k2, err := envString(k, src)
 		if err != nil {
-			return nil, err
+			return nil, withKey(err, k)
 		}
 
-		v, err = env(v)
+		v, err = env(v, src)
 		if err != nil {
-			return nil, err
+			return nil, withKey(err, k)
 		}
 
-		return map[string]any{k: v}, nil
+		return map[string]any{k2: v}, nil
 	})
 }
 
-func envList(obj []any) ([]any, error) {
+func envList(obj []any, src envSource) ([]any, error) {
+	i := -1
+
 	return filterList(obj, func(v any) ([]any, error) {
-		v, err := env(v)
+		i++
+
+		v, err := env(v, src)
 		if err != nil {
-			return nil, err
+			return nil, withIndex(err, i)
 		}
 
 		return []any{v}, nil
 	})
 }
 
-func envString(obj string) (string, error) {
+func envString(obj string, src envSource) (string, error) {
+	if strings.HasPrefix(obj, "$interp:") {
+		return envInterp(obj, src)
+	}
+
 	if !strings.HasPrefix(obj, "$env:") {
 		return obj, nil
 	}
 
-	v, found := os.LookupEnv(strings.TrimPrefix(obj, "$env:"))
+	v, found := src.lookup(strings.TrimPrefix(obj, "$env:"))
 	if !found {
-		return "", fmt.Errorf("%s: %w", obj, ErrMissingEnv)
+		return "", withDirective(fmt.Errorf("%s: %w", obj, ErrMissingEnv), "$env")
 	}
 
 	return v, nil
 }
+
+// envValue resolves the map form of $env:
+//
+//	$env: NAME
+//	$default: value  # used as-is if NAME is unset
+//	$type: int       # string (default), int, float, bool, json or yaml
+//	$error: message  # returned if NAME is unset and there's no $default
+//
+// If NAME ends in "*", it's a prefix and the result is a map of every
+// variable that starts with it (see envPrefix).
+func envValue(obj map[string]any, src envSource) (any, error) {
+	var name, typ, msg string
+
+	opts := envPrefixOptions{strip: true, lower: true, nest: true}
+
+	for k, v := range obj {
+		switch k {
+		case "$env", "$type", "$error":
+			v2, ok := v.(string)
+			if !ok {
+				return nil, withKey(fmt.Errorf("%T: %w", v, ErrInvalidType), k)
+			}
+
+			switch k {
+			case "$env":
+				name = v2
+			case "$type":
+				typ = v2
+			case "$error":
+				msg = v2
+			}
+
+		case "$strip", "$lower", "$nest":
+			v2, ok := v.(bool)
+			if !ok {
+				return nil, withKey(fmt.Errorf("%T: %w", v, ErrInvalidType), k)
+			}
+
+			switch k {
+			case "$strip":
+				opts.strip = v2
+			case "$lower":
+				opts.lower = v2
+			case "$nest":
+				opts.nest = v2
+			}
+
+		case "$default":
+
+		default:
+			return nil, fmt.Errorf("%s: %w", k, ErrExtraKeys)
+		}
+	}
+
+	switch typ {
+	case "", "string", "int", "float", "bool", "json", "yaml":
+	default:
+		return nil, withKey(fmt.Errorf("%s: %w", typ, ErrInvalidArguments), "$type")
+	}
+
+	prefix := strings.TrimSuffix(name, "*")
+	isPrefix := prefix != name
+
+	for _, k := range []string{"$strip", "$lower", "$nest"} {
+		if _, found := obj[k]; found && !isPrefix {
+			return nil, fmt.Errorf("%s without prefix: %w", k, ErrInvalidArguments)
+		}
+	}
+
+	var (
+		ret   any
+		found bool
+		err   error
+	)
+
+	if isPrefix {
+		ret, found, err = envPrefix(prefix, typ, opts, src)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var v string
+
+		v, found = src.lookup(name)
+		if found {
+			ret, err = envConvert(v, typ)
+			if err != nil {
+				return nil, fmt.Errorf("%s=%q as %s: %w", name, v, typ, err)
+			}
+		}
+	}
+
+	if !found {
+		if def, found := obj["$default"]; found {
+			return def, nil
+		}
+
+		if msg != "" {
+			return nil, fmt.Errorf("%s: %s: %w", name, msg, ErrMissingEnv)
+		}
+
+		if !isPrefix {
+			return nil, fmt.Errorf("%s: %w", name, ErrMissingEnv)
+		}
+	}
+
+	return ret, nil
+}
+
+// envPrefixOptions are the key transformations applied by envPrefix.
+type envPrefixOptions struct {
+	strip bool // remove the prefix
+	lower bool // lowercase
+	nest  bool // split on "__" into nested maps
+}
+
+// envPrefix returns a map of the variables whose names start with prefix,
+// with their values converted to typ and their names transformed by opts,
+// and whether any were found. With nest, APP_DB__HOST and APP_DB__PORT
+// become {db: {host: ..., port: ...}}. Variables whose transformed names
+// have an empty key are skipped.
+func envPrefix(prefix, typ string, opts envPrefixOptions, src envSource) (map[string]any, bool, error) {
+	if src.names == nil {
+		return nil, false, fmt.Errorf("%s*: variables can't be listed: %w", prefix, ErrInvalidArguments)
+	}
+
+	names := []string{}
+
+	for _, name := range src.names() {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+
+	polyfill.SlicesSort(names)
+
+	ret := map[string]any{}
+
+	for _, name := range names {
+		v, found := src.lookup(name)
+		if !found {
+			continue
+		}
+
+		val, err := envConvert(v, typ)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s=%q as %s: %w", name, v, typ, err)
+		}
+
+		key := name
+		if opts.strip {
+			key = strings.TrimPrefix(key, prefix)
+		}
+
+		if opts.lower {
+			key = strings.ToLower(key)
+		}
+
+		parts := []string{key}
+		if opts.nest {
+			parts = strings.Split(key, "__")
+		}
+
+		if polyfill.SlicesContains(parts, "") {
+			// e.g. APP_ itself or APP_A__, which have no name for the value
+			continue
+		}
+
+		err = envPrefixSet(ret, parts, val)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return ret, len(ret) > 0, nil
+}
+
+// envPrefixSet sets the value at the nested keys parts of m, creating maps
+// as needed.
+func envPrefixSet(m map[string]any, parts []string, v any) error {
+	for _, part := range parts[:len(parts)-1] {
+		switch next := m[part].(type) {
+		case nil:
+			m2 := map[string]any{}
+			m[part] = m2
+			m = m2
+
+		case map[string]any:
+			m = next
+
+		default:
+			return fmt.Errorf("%s is both a value and a map: %w", part, ErrInvalidArguments)
+		}
+	}
+
+	last := parts[len(parts)-1]
+
+	if _, found := m[last]; found {
+		return fmt.Errorf("%s is set more than once: %w", last, ErrInvalidArguments)
+	}
+
+	m[last] = v
+
+	return nil
+}
+
+// envConvert converts the environment variable value v to typ.
+func envConvert(v, typ string) (any, error) {
+	switch typ {
+	case "", "string":
+		return v, nil
+
+	case "int":
+		i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return nil, ErrInvalidType
+		}
+
+		return i, nil
+
+	case "float":
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, ErrInvalidType
+		}
+
+		return f, nil
+
+	case "bool":
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return nil, ErrInvalidType
+		}
+
+		return b, nil
+
+	case "json", "yaml":
+		unmarshal := jsonUnmarshalStream
+		if typ == "yaml" {
+			unmarshal = yamlUnmarshalStream
+		}
+
+		docs, err := unmarshal([]byte(v))
+		if err != nil {
+			return nil, polyfill.ErrorsJoin(ErrUnmarshal, err)
+		}
+
+		if len(docs) != 1 {
+			return nil, fmt.Errorf("%d documents: %w", len(docs), ErrInvalidType)
+		}
+
+		return normalize(docs[0])
+
+	default:
+		return nil, fmt.Errorf("%s: %w", typ, ErrInvalidArguments)
+	}
+}
+
+// envInterp replaces "$(env:NAME)" references in the "$interp:<string>" obj
+// with the value of environment variable NAME, escaped so that it's inserted
+// literally. Other references and escapes are resolved at output.
+func envInterp(obj string, src envSource) (string, error) {
+	return interpolate(obj, false, func(ref string) (string, bool, error) {
+		if !strings.HasPrefix(ref, "env:") {
+			return "", false, nil
+		}
+
+		v, found := src.lookup(strings.TrimPrefix(ref, "env:"))
+		if !found {
+			return "", false, fmt.Errorf("%s: %w", ref, ErrMissingEnv)
+		}
+
+		return escapeInterp(v), true, nil
+	})
+}
+
+// ReadEnvFile reads environment variables from a dotenv-style file, suitable
+// for passing to [Parser.SetEnvMap].
+//
+// Each non-empty line that isn't a # comment has the form KEY=VALUE, optionally
+// preceded by "export". Values may be wrapped in single quotes (taken
+// literally) or double quotes (Go escape sequences are interpreted).
+// Unquoted values have trailing # comments and surrounding whitespace removed.
+func ReadEnvFile(path string) (map[string]string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, polyfill.ErrorsJoin(fmt.Errorf("%s: %w", path, ErrMissingFile), err)
+	}
+
+	defer fh.Close()
+
+	ret := map[string]string{}
+	scanner := bufio.NewScanner(fh)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		k, v, found := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+
+		if !found || k == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE: %w", path, lineNum, ErrUnmarshal)
+		}
+
+		v, err = envFileValue(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+
+		ret[k] = v
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, polyfill.ErrorsJoin(fmt.Errorf("%s: %w", path, ErrUnmarshal), err)
+	}
+
+	return ret, nil
+}
+
+func envFileValue(v string) (string, error) {
+	switch {
+	case len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'':
+		return v[1 : len(v)-1], nil
+
+	case len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"':
+		ret, err := strconv.Unquote(v)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", v, ErrUnmarshal)
+		}
+
+		return ret, nil
+
+	default:
+		if i := strings.Index(v, " #"); i >= 0 {
+			v = v[:i]
+		}
+
+		return strings.TrimSpace(v), nil
+	}
+}
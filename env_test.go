@@ -19,3 +19,79 @@ func TestEnv(t *testing.T) { //nolint:paralleltest
 	require.Equal(t, `{"a":"xyz"}
 `, string(blob))
 }
+
+func TestEnvMap(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+	b.SetEnvMap(map[string]string{"FOO": "abc"})
+
+	require.NoError(t, b.MergeFileLayers("tests/env-map-value/a.yaml"))
+
+	blob, err := b.Output("json")
+	require.NoError(t, err)
+	require.Equal(t, `{"a":"abc"}
+`, string(blob))
+
+	b = bkl.New()
+	b.SetEnvMap(map[string]string{})
+
+	require.ErrorIs(t, b.MergeFileLayers("tests/env-map-value/a.yaml"), bkl.ErrMissingEnv)
+}
+
+func TestEnvTyped(t *testing.T) {
+	t.Parallel()
+
+	env := map[string]string{
+		"PORT":   "8080",
+		"DEBUG":  "true",
+		"RATIO":  "0.5",
+		"TAGS":   `["a","b"]`,
+		"LIMITS": "{cpu: 2}",
+	}
+
+	b := bkl.New()
+	b.SetEnvMap(env)
+
+	require.NoError(t, b.MergeFileLayers("tests/env-typed/a.yaml"))
+
+	blob, err := b.Output("json")
+	require.NoError(t, err)
+	require.Equal(t, `{"debug":true,"host":"localhost","limits":{"cpu":2},"port":8080,"ratio":0.5,"tags":["a","b"],"timeout":30}
+`, string(blob))
+
+	env["PORT"] = "http"
+	b = bkl.New()
+	b.SetEnvMap(env)
+	require.ErrorIs(t, b.MergeFileLayers("tests/env-typed/a.yaml"), bkl.ErrInvalidType)
+
+	b = bkl.New()
+	b.SetEnvMap(map[string]string{})
+	err = b.MergeFileLayers("tests/env-error/a.yaml")
+	require.ErrorIs(t, err, bkl.ErrMissingEnv)
+	require.ErrorContains(t, err, "set API_TOKEN to the deploy token")
+}
+
+func TestEnvPrefix(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+	b.SetEnvMap(map[string]string{
+		"APP_A":        "1",
+		"APP_DB__PORT": "5432",
+		"APP_":         "2",
+		"APP_B__":      "3",
+		"OTHER":        "x",
+	})
+
+	require.NoError(t, b.MergeFileLayers("tests/env-prefix-options/a.yaml"))
+
+	blob, err := b.Output("json")
+	require.NoError(t, err)
+	require.Equal(t, `{"features":{"a":1,"db":{"port":5432}},"none":{},"raw":{"APP_DB__PORT":"5432"}}
+`, string(blob))
+
+	b = bkl.New()
+	b.SetEnv(func(string) (string, bool) { return "", false })
+	require.ErrorIs(t, b.MergeFileLayers("tests/env-prefix-options/a.yaml"), bkl.ErrInvalidArguments)
+}
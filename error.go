@@ -1,12 +1,19 @@
 package bkl
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gopatchy/bkl/polyfill"
+)
 
 var (
 	// Base error; every error in bkl inherits from this
 	Err = fmt.Errorf("bkl error")
 
 	// Format and system errors
+	ErrCircularParent    = fmt.Errorf("circular $parent (%w)", Err)
 	ErrCircularRef       = fmt.Errorf("circular reference (%w)", Err)
 	ErrConflictingParent = fmt.Errorf("conflicting $parent (%w)", Err)
 	ErrExtraEntries      = fmt.Errorf("extra entries (%w)", Err)
@@ -30,3 +37,203 @@ var (
 	ErrUnmarshal         = fmt.Errorf("decoding error (%w)", Err)
 	ErrUselessOverride   = fmt.Errorf("useless override (%w)", Err)
 )
+
+var sentinels = []error{
+	ErrCircularParent,
+	ErrCircularRef,
+	ErrConflictingParent,
+	ErrExtraEntries,
+	ErrExtraKeys,
+	ErrInvalidArguments,
+	ErrInvalidDirective,
+	ErrInvalidIndex,
+	ErrInvalidFilename,
+	ErrInvalidType,
+	ErrInvalidParent,
+	ErrMarshal,
+	ErrRefNotFound,
+	ErrMissingEnv,
+	ErrMissingFile,
+	ErrMissingMatch,
+	ErrMultiMatch,
+	ErrNoMatchFound,
+	ErrOutputFile,
+	ErrRequiredField,
+	ErrUnknownFormat,
+	ErrUnmarshal,
+	ErrUselessOverride,
+}
+
+// An Error describes where in the input an error occurred. Errors returned
+// while loading, merging and outputting documents can be inspected with
+// [errors.As]; [errors.Is] still matches the underlying sentinel (e.g.
+// [ErrRequiredField]).
+type Error struct {
+	// Err is the underlying error.
+	Err error
+
+	// Path is the dotted key path within the document, e.g. "a.b[2].c".
+	// Empty for errors that apply to the whole document.
+	Path string
+
+	// File is the path of the file being loaded or merged. It is empty for
+	// errors during output, since output documents may come from many files;
+	// see Positions instead.
+	File string
+
+	// Doc is the index of the document within File or, during output, within
+	// [Parser.Documents]. -1 if unknown.
+	Doc int
+
+	// Directive is the directive being evaluated, e.g. "$merge", "$match" or
+	// "$encode:base64". Empty if not evaluating a directive.
+	Directive string
+
+	// Positions are the source locations of Path in each layer involved, most
+	// recent layer first.
+	Positions []Position
+}
+
+func (e *Error) Error() string {
+	msg := e.Err.Error()
+
+	if e.Path != "" {
+		msg = fmt.Sprintf("%s: %s", e.Path, msg)
+	}
+
+	switch {
+	case len(e.Positions) > 0:
+		strs := []string{}
+
+		for _, pos := range e.Positions {
+			strs = append(strs, pos.String())
+		}
+
+		return fmt.Sprintf("%s: %s", strings.Join(strs, ", "), msg)
+
+	case e.File != "" && e.Doc >= 0:
+		return fmt.Sprintf("[%s:doc%d]: %s", e.File, e.Doc, msg)
+
+	case e.File != "":
+		return fmt.Sprintf("[%s]: %s", e.File, msg)
+
+	default:
+		return msg
+	}
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Sentinel returns the Err* value (e.g. [ErrRequiredField]) that Err wraps,
+// or nil if none.
+func (e *Error) Sentinel() error {
+	for _, sentinel := range sentinels {
+		if errors.Is(e.Err, sentinel) {
+			return sentinel
+		}
+	}
+
+	return nil
+}
+
+// toError returns a copy of err as an *Error, so that annotating it doesn't
+// affect other holders of err.
+func toError(err error) *Error {
+	if e, ok := err.(*Error); ok { //nolint:errorlint
+		ret := *e
+		ret.Positions = polyfill.SlicesClone(e.Positions)
+
+		return &ret
+	}
+
+	return &Error{
+		Err: err,
+		Doc: -1,
+	}
+}
+
+// withKey prepends key to the path of err. The path is built up as the error
+// propagates out of nested maps and lists.
+func withKey(err error, key string) error {
+	e := toError(err)
+	e.Path = joinPath(key, e.Path)
+
+	if strings.HasPrefix(key, "$") && e.Directive == "" {
+		e.Directive = key
+	}
+
+	return e
+}
+
+func withIndex(err error, i int) error {
+	return withKey(err, fmt.Sprintf("[%d]", i))
+}
+
+// withDirective records the directive being evaluated when err occurred, if
+// a more specific one isn't already set.
+func withDirective(err error, directive string) error {
+	e := toError(err)
+
+	if e.Directive == "" {
+		e.Directive = directive
+	}
+
+	return e
+}
+
+// withDocument records the file and document index that err occurred in, if
+// not already set.
+func withDocument(err error, file string, doc int) error {
+	e := toError(err)
+
+	if e.File == "" {
+		e.File = file
+	}
+
+	if e.Doc < 0 {
+		e.Doc = doc
+	}
+
+	return e
+}
+
+func joinPath(prefix, path string) string {
+	switch {
+	case path == "":
+		return prefix
+	case strings.HasPrefix(path, "["):
+		return prefix + path
+	default:
+		return keyPath(prefix, path)
+	}
+}
+
+// annotateError adds the source positions of the failing key path within
+// docs to err. Documents should be ordered from most to least recent layer.
+func annotateError(err error, docs ...*Document) error {
+	e := toError(err)
+
+	if len(e.Positions) > 0 {
+		// Already annotated by an inner merge
+		return e
+	}
+
+	for _, doc := range docs {
+		e.Positions = append(e.Positions, doc.positions.lookup(e.Path)...)
+	}
+
+	return e
+}
+
+// annotateMergeError is like annotateError for an error that occurred while
+// merging patch into doc. Paths are relative to patch; they only identify the
+// same value in doc if they don't pass through a list.
+func annotateMergeError(err error, patch, doc *Document) error {
+	if strings.Contains(toError(err).Path, "[") {
+		return annotateError(err, patch)
+	}
+
+	return annotateError(err, patch, doc)
+}
@@ -0,0 +1,61 @@
+package bkl_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gopatchy/bkl"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorMerge(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	err := b.MergeFileLayers("tests/merge-map-useless/a.b.yaml")
+
+	var e *bkl.Error
+	require.True(t, errors.As(err, &e))
+	require.Equal(t, bkl.ErrUselessOverride, e.Sentinel())
+	require.Equal(t, "a", e.Path)
+	require.Equal(t, "tests/merge-map-useless/a.b.yaml", e.File)
+	require.Equal(t, 0, e.Doc)
+	require.Equal(t, "", e.Directive)
+	require.Len(t, e.Positions, 2)
+}
+
+func TestErrorOutput(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	require.NoError(t, b.MergeFileLayers("tests/error-output/a.yaml"))
+
+	_, err := b.Output("json")
+	require.ErrorIs(t, err, bkl.ErrRefNotFound)
+
+	var e *bkl.Error
+	require.True(t, errors.As(err, &e))
+	require.Equal(t, "b[1].y.$merge", e.Path)
+	require.Equal(t, "", e.File)
+	require.Equal(t, 1, e.Doc)
+	require.Equal(t, "$merge", e.Directive)
+	require.Equal(t, []bkl.Position{{File: "tests/error-output/a.yaml", Line: 6, Column: 7}}, e.Positions)
+}
+
+func TestErrorEncode(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	require.NoError(t, b.MergeFileLayers("tests/error-encode/a.yaml"))
+
+	_, err := b.Output("json")
+	require.ErrorIs(t, err, bkl.ErrInvalidArguments)
+
+	var e *bkl.Error
+	require.True(t, errors.As(err, &e))
+	require.Equal(t, "a.$encode", e.Path)
+	require.Equal(t, "$encode:tolist", e.Directive)
+}
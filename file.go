@@ -3,10 +3,12 @@ package bkl
 import (
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/gopatchy/bkl/polyfill"
 	"go.jetpack.io/typeid"
 )
 
@@ -19,106 +21,350 @@ type fileID struct {
 }
 
 type file struct {
-	id    fileID
-	child *file
-	path  string
-	docs  []*Document
+	id   fileID
+	path string
+	fsys fs.FS
+	docs []*Document
+
+	// virtual files (stdin, readers) don't exist on disk, so only $parent
+	// can specify their parents.
+	virtual bool
+
+	// link is the path that f was loaded from, if it is a symlink to path.
+	link string
+
+	// hash is the hash of the file's contents and envKey the values of the
+	// variables looked up by $env while loading it, for caching.
+	hash   string
+	envKey string
+
+	// includes are the paths of files read by $file and $import, and
+	// includeKey their hashes, for caching.
+	includes   []string
+	includeKey string
 }
 
-func (p *Parser) loadFile(path string, child *file) (*file, error) {
+// A parentRef is a parent of a file and how it was specified: "filename",
+// "symlink", "$parent" or "glob" (a $parent pattern).
+type parentRef struct {
+	path string
+	via  string
+}
+
+func (p *Parser) loadFile(path string) (*file, error) {
+	if isStdin(path) {
+		return p.loadReader(os.Stdin, ext(path), path, true)
+	}
+
+	fh, err := openFile(p.fsys, path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	defer fh.Close()
+
+	return p.loadReader(fh, ext(path), path, false)
+}
+
+func (p *Parser) loadReader(r io.Reader, formatName, path string, virtual bool) (*file, error) {
 	f := &file{
-		id:    typeid.Must(typeid.New[fileID]()),
-		child: child,
-		path:  path,
+		id:      typeid.Must(typeid.New[fileID]()),
+		path:    path,
+		fsys:    p.fsys,
+		virtual: virtual,
 	}
 
 	p.log("[%s] loading", f)
 
-	format, err := GetFormat(ext(path))
+	format, err := GetFormat(formatName)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", path, err)
 	}
 
-	var fh io.ReadCloser
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	f.hash = contentHash(raw)
+	cacheKey := fileCacheKey(formatName, path, f.hash)
 
-	if isStdin(path) {
-		fh = os.Stdin
+	cached, found := p.cache.getFile(cacheKey)
+	if virtual || !found {
+		cached, err = parseDocs(format, raw, path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !virtual {
+			p.cache.putFile(cacheKey, cached)
+		}
+	}
+
+	envKey := &strings.Builder{}
+	lookup := func(key string) (string, bool) {
+		v, found := p.env(key)
+		fmt.Fprintf(envKey, "%q=%q,%t ", key, v, found)
+
+		return v, found
+	}
+
+	var names func() []string
+
+	if p.envNames != nil {
+		names = func() []string {
+			ret := p.envNames()
+			fmt.Fprintf(envKey, "%q ", ret)
+
+			return ret
+		}
 	}
 
-	if fh == nil {
-		fh, err = os.Open(path)
+	includeKey := &strings.Builder{}
+	read := func(rel string, limit int64) ([]byte, error) {
+		path := filepath.Join(filepath.Dir(f.path), rel)
+
+		raw, err := readFile(p.fsys, path, limit)
 		if err != nil {
-			return nil, fmt.Errorf("%s: %w", path, err)
+			return nil, err
+		}
+
+		if !polyfill.SlicesContains(f.includes, path) {
+			f.includes = append(f.includes, path)
 		}
 
-		defer fh.Close()
+		fmt.Fprintf(includeKey, "%q=%q ", path, contentHash(raw))
+
+		return raw, nil
 	}
 
-	raw, err := io.ReadAll(fh)
-	if err != nil {
-		return nil, err
+	for i, c := range cached {
+		doc := NewDocumentWithData(c.data)
+		doc.positions = c.positions
+		doc.comments = c.comments
+
+		doc.Data, err = env(doc.Data, envSource{lookup: lookup, names: names})
+		if err != nil {
+			return nil, annotateError(withDocument(err, path, i), doc)
+		}
+
+		doc.Data, err = include(doc.Data, read)
+		if err != nil {
+			return nil, annotateError(withDocument(err, path, i), doc)
+		}
+
+		doc.imports, err = p.loadImports(f, doc, includeKey)
+		if err != nil {
+			return nil, withDocument(withDirective(err, "$import"), path, i)
+		}
+
+		doc.origin = Source{Position: Position{File: path}, Doc: i}
+
+		f.docs = append(f.docs, doc)
+	}
+
+	f.envKey = envKey.String()
+	f.includeKey = includeKey.String()
+
+	return f, nil
+}
+
+// parseDocs parses and normalizes the documents in raw.
+func parseDocs(format *Format, raw []byte, path string) ([]cachedDoc, error) {
+	var (
+		docs []any
+		poss []positions
+		cmts []comments
+		err  error
+	)
+
+	switch {
+	case format.unmarshalStreamComments != nil:
+		docs, poss, cmts, err = format.unmarshalStreamComments(raw)
+	case format.unmarshalStreamPositions != nil:
+		docs, poss, err = format.unmarshalStreamPositions(raw)
+	default:
+		docs, err = format.UnmarshalStream(raw)
 	}
 
-	docs, err := format.UnmarshalStream(raw)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", path, err)
 	}
 
-	for i, doc := range docs {
-		doc, err = normalize(doc)
-		if err != nil {
-			return nil, fmt.Errorf("[doc%d]: %w", i, err)
+	ret := []cachedDoc{}
+
+	for i, data := range docs {
+		c := cachedDoc{positions: positions{}}
+
+		if i < len(poss) {
+			c.positions = poss[i]
+			c.positions.setFile(path)
 		}
 
-		doc, err = env(doc)
+		if i < len(cmts) {
+			c.comments = cmts[i]
+		}
+
+		c.data, err = normalize(data)
 		if err != nil {
-			return nil, fmt.Errorf("[doc%d]: %w", i, err)
+			doc := NewDocumentWithData(data)
+			doc.positions = c.positions
+
+			return nil, annotateError(withDocument(err, path, i), doc)
 		}
 
-		f.docs = append(f.docs, NewDocumentWithData(doc))
+		ret = append(ret, c)
 	}
 
-	f.setParents()
+	return ret, nil
+}
 
-	return f, nil
+func (p *Parser) loadFileAndParents(path string) ([]*file, error) {
+	f, err := p.loadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.loadParents(f)
 }
 
-func (p *Parser) loadFileAndParents(path string, child *file) ([]*file, error) {
-	f, err := p.loadFile(path, child)
+// loadParents loads the ancestors of f and returns them in merge order,
+// followed by f itself.
+//
+// Ancestors reachable through several parents are loaded and merged once.
+// The merge order is the reverse of the C3 linearization (as used for Python's
+// method resolution order) with later parents taking precedence, so every
+// file is merged after all of its parents. Each match of a $parent glob
+// pattern starts a separate hierarchy instead, with its own copies of shared
+// ancestors, so that each variant selected by the pattern produces its own
+// documents. An ancestor reached both through a glob match and otherwise is
+// therefore merged once for each match and once more for the other paths.
+func (p *Parser) loadParents(f *file) ([]*file, error) {
+	mro, err := p.fileMRO(f, map[string]*file{f.path: f}, []string{f.path}, map[*file][]*file{})
 	if err != nil {
 		return nil, err
 	}
 
-	parents, err := f.parents()
+	files := polyfill.SlicesClone(mro)
+	polyfill.SlicesReverse(files)
+
+	return files, nil
+}
+
+// fileMRO loads the parents of f and returns f followed by its ancestors,
+// most specific first. scope holds the files already loaded in this
+// hierarchy, which glob matches don't share, chain the paths from the root to
+// f, and mros the results for files already linearized.
+func (p *Parser) fileMRO(f *file, scope map[string]*file, chain []string, mros map[*file][]*file) ([]*file, error) {
+	if mro, found := mros[f]; found {
+		return mro, nil
+	}
+
+	refs, err := f.parents()
 	if err != nil {
 		return nil, err
 	}
 
-	files := []*file{}
+	// Linearize parents in reverse so that later ones take precedence
+	seqs := [][]*file{}
+	direct := []*file{}
+
+	for _, ref := range refs {
+		if polyfill.SlicesContains(chain, ref.path) {
+			loop := append(polyfill.SlicesClone(chain), ref.path)
+			return nil, fmt.Errorf("%s: %w", strings.Join(loop, " -> "), ErrCircularParent)
+		}
+
+		parentScope := scope
+		if ref.via == "glob" {
+			parentScope = map[string]*file{}
+		}
+
+		parent, found := parentScope[ref.path]
+		if !found {
+			parent, err = p.loadFile(ref.path)
+			if err != nil {
+				return nil, err
+			}
+
+			parentScope[ref.path] = parent
+		}
+
+		if polyfill.SlicesContains(direct, parent) {
+			continue
+		}
+
+		for _, doc := range f.docs {
+			doc.AddParents(parent.docs...)
+		}
 
-	for _, parent := range parents {
-		parentFiles, err := p.loadFileAndParents(parent, f)
+		parentChain := append(polyfill.SlicesClone(chain), ref.path)
+
+		mro, err := p.fileMRO(parent, parentScope, parentChain, mros)
 		if err != nil {
 			return nil, err
 		}
 
-		files = append(files, parentFiles...)
+		seqs = append([][]*file{mro}, seqs...)
+		direct = append([]*file{parent}, direct...)
+	}
+
+	mro, ok := c3Merge(append(seqs, direct))
+	if !ok {
+		return nil, fmt.Errorf("[%s]: inconsistent $parent order: %w", f, ErrInvalidParent)
 	}
 
-	return append(files, f), nil
+	mro = append([]*file{f}, mro...)
+	mros[f] = mro
+
+	return mro, nil
 }
 
-func (f *file) setParents() {
-	if f.child == nil {
-		return
+// c3Merge merges linearizations, preserving the order within each. Returns
+// false if there is no consistent order.
+func c3Merge(seqs [][]*file) ([]*file, bool) {
+	ret := []*file{}
+
+	for {
+		seqs = polyfill.SlicesDeleteFunc(seqs, func(seq []*file) bool { return len(seq) == 0 })
+		if len(seqs) == 0 {
+			return ret, true
+		}
+
+		var next *file
+
+		for _, seq := range seqs {
+			if !inTails(seqs, seq[0]) {
+				next = seq[0]
+				break
+			}
+		}
+
+		if next == nil {
+			return nil, false
+		}
+
+		ret = append(ret, next)
+
+		for i, seq := range seqs {
+			if seq[0] == next {
+				seqs[i] = seq[1:]
+			}
+		}
 	}
+}
 
-	for _, doc := range f.child.docs {
-		doc.AddParents(f.docs...)
+func inTails(seqs [][]*file, f *file) bool {
+	for _, seq := range seqs {
+		if polyfill.SlicesContains(seq[1:], f) {
+			return true
+		}
 	}
+
+	return false
 }
 
-func (f *file) parents() ([]string, error) {
+func (f *file) parents() ([]parentRef, error) {
 	parents, err := f.parentsFromDirective()
 	if err != nil {
 		return nil, err
@@ -140,7 +386,7 @@ func (f *file) parents() ([]string, error) {
 	return f.parentsFromFilename()
 }
 
-func (f *file) parentsFromDirective() ([]string, error) {
+func (f *file) parentsFromDirective() ([]parentRef, error) {
 	parents := []string{}
 	noParent := false
 
@@ -179,7 +425,7 @@ func (f *file) parentsFromDirective() ([]string, error) {
 			return nil, fmt.Errorf("$parent=false and $parent=<string> in same file: %w", ErrConflictingParent)
 		}
 
-		return []string{}, nil
+		return []parentRef{}, nil
 	}
 
 	if len(parents) == 0 {
@@ -189,12 +435,12 @@ func (f *file) parentsFromDirective() ([]string, error) {
 	return f.toAbsolutePaths(parents)
 }
 
-func (f *file) parentsFromSymlink() ([]string, error) {
-	if isStdin(f.path) {
+func (f *file) parentsFromSymlink() ([]parentRef, error) {
+	if f.virtual {
 		return nil, nil
 	}
 
-	dest, err := filepath.EvalSymlinks(f.path)
+	dest, err := evalSymlinks(f.fsys, f.path)
 	if err != nil {
 		return nil, err
 	}
@@ -204,14 +450,24 @@ func (f *file) parentsFromSymlink() ([]string, error) {
 		return nil, nil
 	}
 
+	f.link = f.path
 	f.path = dest
 
-	return f.parentsFromFilename()
+	refs, err := f.parentsFromFilename()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range refs {
+		refs[i].via = "symlink"
+	}
+
+	return refs, nil
 }
 
-func (f *file) parentsFromFilename() ([]string, error) {
-	if isStdin(f.path) {
-		return []string{}, nil
+func (f *file) parentsFromFilename() ([]parentRef, error) {
+	if f.virtual {
+		return []parentRef{}, nil
 	}
 
 	dir := filepath.Dir(f.path)
@@ -225,27 +481,32 @@ func (f *file) parentsFromFilename() ([]string, error) {
 		return nil, fmt.Errorf("[%s] %w", f.path, ErrInvalidFilename)
 
 	case len(parts) == 2:
-		return []string{}, nil
+		return []parentRef{}, nil
 
 	default:
 		layerPath := filepath.Join(dir, strings.Join(parts[:len(parts)-2], "."))
 
-		extPath := findFile(layerPath)
+		extPath := findFile(f.fsys, layerPath)
 		if extPath == "" {
 			return nil, fmt.Errorf("[%s]: %w", layerPath, ErrMissingFile)
 		}
 
-		return []string{extPath}, nil
+		return []parentRef{{path: extPath, via: "filename"}}, nil
 	}
 }
 
-func (f *file) toAbsolutePaths(paths []string) ([]string, error) {
-	ret := []string{}
+func (f *file) toAbsolutePaths(paths []string) ([]parentRef, error) {
+	ret := []parentRef{}
 
 	for _, path := range paths {
+		via := "$parent"
+		if strings.ContainsAny(path, "*?[") {
+			via = "glob"
+		}
+
 		path = filepath.Join(filepath.Dir(f.path), path)
 
-		matches, err := globFiles(path)
+		matches, err := globFiles(f.fsys, path)
 		if err != nil {
 			return nil, err
 		}
@@ -254,7 +515,9 @@ func (f *file) toAbsolutePaths(paths []string) ([]string, error) {
 			return nil, fmt.Errorf("%s: %w", path, ErrMissingFile)
 		}
 
-		ret = append(ret, matches...)
+		for _, match := range matches {
+			ret = append(ret, parentRef{path: match, via: via})
+		}
 	}
 
 	return ret, nil
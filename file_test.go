@@ -1,7 +1,9 @@
 package bkl_test
 
 import (
+	"io/fs"
 	"testing"
+	"testing/fstest"
 
 	"github.com/gopatchy/bkl"
 	"github.com/stretchr/testify/require"
@@ -32,3 +34,90 @@ func TestParentDirective(t *testing.T) {
 	require.Equal(t, `{"a":1,"b":2}
 `, string(blob))
 }
+
+func TestParentLoop(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	err := b.MergeFileLayers("tests/parent-loop/a.yaml")
+	require.ErrorIs(t, err, bkl.ErrCircularParent)
+	require.ErrorContains(t, err, "tests/parent-loop/a.yaml -> tests/parent-loop/b.yaml -> tests/parent-loop/a.yaml")
+}
+
+func TestFS(t *testing.T) {
+	t.Parallel()
+
+	fsys := fstest.MapFS{
+		"conf/a.yaml":   {Data: []byte("a: 1\n")},
+		"conf/a.b.toml": {Data: []byte("b = 2\n")},
+		"conf/c.yaml":   {Data: []byte("$parent: a.b\nc: 3\n")},
+	}
+
+	b := bkl.New()
+	b.SetFS(fsys)
+
+	require.NoError(t, b.MergeFileLayers("conf/c.yaml"))
+
+	blob, err := b.Output("json")
+	require.NoError(t, err)
+	require.Equal(t, `{"a":1,"b":2,"c":3}
+`, string(blob))
+}
+
+// readLinkFS reports every file as a symlink that can't be read.
+type readLinkFS struct {
+	fstest.MapFS
+}
+
+func (fsys readLinkFS) ReadLink(name string) (string, error) {
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrPermission}
+}
+
+func TestFSReadLinkError(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+	b.SetFS(readLinkFS{fstest.MapFS{
+		"a.yaml": {Data: []byte("a: 1\n")},
+	}})
+
+	require.ErrorIs(t, b.MergeFileLayers("a.yaml"), fs.ErrPermission)
+}
+
+func TestFileDirective(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	require.NoError(t, b.MergeFileLayers("tests/file-base64/conf/a.yaml"))
+	require.Equal(t, []string{"tests/file-base64/conf/a.yaml", "tests/file-base64/conf/a.txt", "tests/file-base64/b.bin"}, b.Files())
+
+	blob, err := b.Output("json")
+	require.NoError(t, err)
+	require.Equal(t, `{"a":"echo $(date) $$(x)\n","b":"/wA="}
+`, string(blob))
+
+	b = bkl.New()
+	require.ErrorIs(t, b.MergeFileLayers("tests/file-base64/conf/c.yaml"), bkl.ErrInvalidType)
+
+	b = bkl.New()
+	require.ErrorIs(t, b.MergeFileLayers("tests/file-base64/conf/d.yaml"), bkl.ErrInvalidArguments)
+}
+
+func TestParentGlobShared(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	require.NoError(t, b.MergeFileLayers("tests/parent-glob-shared/all.yaml"))
+
+	// base.yaml is merged for the direct $parent and again for each match
+	// of r.*
+	blob, err := b.Output("json")
+	require.NoError(t, err)
+	require.Equal(t, `{"a":1,"all":1}
+{"a":1,"all":1,"name":"u1","r":1}
+{"a":1,"all":1,"name":"u2","r":1}
+`, string(blob))
+}
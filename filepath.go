@@ -3,9 +3,15 @@ package bkl
 import (
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
+
+	"github.com/gopatchy/bkl/polyfill"
 )
 
 // FileMatch attempts to find a file with the same base name as path, but
@@ -16,8 +22,14 @@ import (
 // Returns the real filename and the requested output format, or
 // ("", "", error).
 func FileMatch(path string) (string, string, error) {
+	return FileMatchFS(nil, path)
+}
+
+// FileMatchFS is like [FileMatch] but searches fsys instead of the real
+// filesystem. A nil fsys searches the real filesystem.
+func FileMatchFS(fsys fs.FS, path string) (string, string, error) {
 	f := ext(path)
-	if _, found := formatByExtension[f]; !found {
+	if !isFormat(f) {
 		return "", "", fmt.Errorf("%s: %w", f, ErrInvalidType)
 	}
 
@@ -27,7 +39,7 @@ func FileMatch(path string) (string, string, error) {
 		return path, f, nil
 	}
 
-	realPath := findFile(withoutExt)
+	realPath := findFile(fsys, withoutExt)
 
 	if realPath == "" {
 		return "", "", fmt.Errorf("%s.*: %w", withoutExt, ErrMissingFile)
@@ -40,10 +52,10 @@ func ext(path string) string {
 	return strings.TrimPrefix(filepath.Ext(path), ".")
 }
 
-func findFile(path string) string {
-	for ext := range formatByExtension {
+func findFile(fsys fs.FS, path string) string {
+	for _, ext := range Formats() {
 		extPath := fmt.Sprintf("%s.%s", path, ext)
-		if _, err := os.Stat(extPath); errors.Is(err, os.ErrNotExist) {
+		if _, err := statFile(fsys, extPath); errors.Is(err, fs.ErrNotExist) {
 			continue
 		}
 
@@ -53,11 +65,11 @@ func findFile(path string) string {
 	return ""
 }
 
-func globFiles(path string) ([]string, error) {
+func globFiles(fsys fs.FS, path string) ([]string, error) {
 	pat := fmt.Sprintf("%s.*", path)
 	patDots := strings.Count(pat, ".")
 
-	matches, err := filepath.Glob(pat)
+	matches, err := globPath(fsys, pat)
 	if err != nil {
 		return nil, err
 	}
@@ -70,7 +82,7 @@ func globFiles(path string) ([]string, error) {
 			continue
 		}
 
-		if _, found := formatByExtension[ext(match)]; !found {
+		if !isFormat(ext(match)) {
 			// Unsupported extension
 			continue
 		}
@@ -80,3 +92,95 @@ func globFiles(path string) ([]string, error) {
 
 	return ret, nil
 }
+
+// fsPath converts an OS-style path into the slash-separated, unrooted form
+// that fs.FS requires.
+func fsPath(p string) string {
+	return strings.TrimPrefix(path.Clean(filepath.ToSlash(p)), "/")
+}
+
+func openFile(fsys fs.FS, p string) (io.ReadCloser, error) {
+	if fsys == nil {
+		return os.Open(p)
+	}
+
+	return fsys.Open(fsPath(p))
+}
+
+// readFile reads the file at p, returning an error if it's larger than limit
+// bytes (if limit > 0).
+func readFile(fsys fs.FS, p string, limit int64) ([]byte, error) {
+	fh, err := openFile(fsys, p)
+	if err != nil {
+		return nil, polyfill.ErrorsJoin(fmt.Errorf("%s: %w", p, ErrMissingFile), err)
+	}
+
+	defer fh.Close()
+
+	var r io.Reader = fh
+	if limit > 0 {
+		r = io.LimitReader(fh, limit+1)
+	}
+
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+
+	if limit > 0 && int64(len(raw)) > limit {
+		return nil, fmt.Errorf("%s: larger than %d bytes: %w", p, limit, ErrInvalidArguments)
+	}
+
+	return raw, nil
+}
+
+func statFile(fsys fs.FS, p string) (fs.FileInfo, error) {
+	if fsys == nil {
+		return os.Stat(p)
+	}
+
+	return fs.Stat(fsys, fsPath(p))
+}
+
+func globPath(fsys fs.FS, pat string) ([]string, error) {
+	if fsys == nil {
+		return filepath.Glob(pat)
+	}
+
+	return fs.Glob(fsys, fsPath(pat))
+}
+
+// readLinkFS is implemented by filesystems that can report symlink targets
+// (e.g. fs.ReadLinkFS in newer Go versions).
+type readLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+}
+
+func evalSymlinks(fsys fs.FS, p string) (string, error) {
+	if fsys == nil {
+		return filepath.EvalSymlinks(p)
+	}
+
+	rlfs, ok := fsys.(readLinkFS)
+	if !ok {
+		// No symlink support in this filesystem
+		return p, nil
+	}
+
+	dest, err := rlfs.ReadLink(fsPath(p))
+	if err != nil {
+		if errors.Is(err, fs.ErrInvalid) || errors.Is(err, syscall.EINVAL) {
+			// Not a link
+			return p, nil
+		}
+
+		return "", err
+	}
+
+	if !path.IsAbs(dest) {
+		dest = path.Join(path.Dir(fsPath(p)), dest)
+	}
+
+	return dest, nil
+}
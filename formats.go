@@ -2,41 +2,107 @@ package bkl
 
 import (
 	"fmt"
+	"sync"
+
+	"github.com/gopatchy/bkl/polyfill"
 )
 
+// A Format converts between documents and a serialized stream of one or more
+// documents. Documents are trees of map[string]any, []any and scalar values.
 type Format struct {
 	MarshalStream   func([]any) ([]byte, error)
 	UnmarshalStream func([]byte) ([]any, error)
+
+	// unmarshalStreamPositions is like UnmarshalStream but also returns the
+	// source position of each key path in each document.
+	unmarshalStreamPositions func([]byte) ([]any, []positions, error)
+
+	// unmarshalStreamComments is like unmarshalStreamPositions but also
+	// returns the comments attached to each key path in each document.
+	unmarshalStreamComments func([]byte) ([]any, []positions, []comments, error)
+
+	// ordered is true if MarshalStream accepts orderedMaps in place of maps.
+	ordered bool
+
+	// commented is true if MarshalStream writes the comments of
+	// orderedMaps.
+	commented bool
 }
 
-var formatByExtension = map[string]Format{
-	"json": {
-		MarshalStream:   jsonMarshalStream,
-		UnmarshalStream: jsonUnmarshalStream,
-	},
-	"jsonl": {
-		MarshalStream:   jsonMarshalStream,
-		UnmarshalStream: jsonUnmarshalStream,
-	},
-	"json-pretty": {
-		MarshalStream:   jsonMarshalStreamPretty,
-		UnmarshalStream: jsonUnmarshalStream,
-	},
-	"toml": {
-		MarshalStream:   tomlMarshalStream,
-		UnmarshalStream: tomlUnmarshalStream,
-	},
-	"yaml": {
-		MarshalStream:   yamlMarshalStream,
-		UnmarshalStream: yamlUnmarshalStream,
-	},
-	"yml": {
-		MarshalStream:   yamlMarshalStream,
-		UnmarshalStream: yamlUnmarshalStream,
-	},
+var (
+	formatMu          sync.RWMutex
+	formatByExtension = map[string]Format{
+		"json": {
+			MarshalStream:            jsonMarshalStream,
+			UnmarshalStream:          jsonUnmarshalStream,
+			unmarshalStreamPositions: jsonUnmarshalStreamPositions,
+			ordered:                  true,
+		},
+		"jsonl": {
+			MarshalStream:            jsonMarshalStream,
+			UnmarshalStream:          jsonUnmarshalStream,
+			unmarshalStreamPositions: jsonUnmarshalStreamPositions,
+			ordered:                  true,
+		},
+		"json-pretty": {
+			MarshalStream:            jsonMarshalStreamPretty,
+			UnmarshalStream:          jsonUnmarshalStream,
+			unmarshalStreamPositions: jsonUnmarshalStreamPositions,
+			ordered:                  true,
+		},
+		"toml": {
+			MarshalStream:            tomlMarshalStream,
+			UnmarshalStream:          tomlUnmarshalStream,
+			unmarshalStreamPositions: tomlUnmarshalStreamPositions,
+			ordered:                  true,
+			commented:                true,
+		},
+		"yaml": {
+			MarshalStream:            yamlMarshalStream,
+			UnmarshalStream:          yamlUnmarshalStream,
+			unmarshalStreamPositions: yamlUnmarshalStreamPositions,
+			unmarshalStreamComments:  yamlUnmarshalStreamComments,
+			ordered:                  true,
+			commented:                true,
+		},
+		"yml": {
+			MarshalStream:            yamlMarshalStream,
+			UnmarshalStream:          yamlUnmarshalStream,
+			unmarshalStreamPositions: yamlUnmarshalStreamPositions,
+			unmarshalStreamComments:  yamlUnmarshalStreamComments,
+			ordered:                  true,
+			commented:                true,
+		},
+	}
+)
+
+// RegisterFormat makes a format available under name. The name is used as
+// the file extension when finding and globbing layers, as the output format
+// name, and in $encode:<name>.
+//
+// Registering an existing name replaces that format, including the built-in
+// ones. RegisterFormat panics if either function in f is nil.
+func RegisterFormat(name string, f Format) {
+	if f.MarshalStream == nil || f.UnmarshalStream == nil {
+		panic(fmt.Sprintf("bkl: RegisterFormat %s: nil function", name))
+	}
+
+	f.unmarshalStreamPositions = nil
+	f.unmarshalStreamComments = nil
+	f.ordered = false
+	f.commented = false
+
+	formatMu.Lock()
+	defer formatMu.Unlock()
+
+	formatByExtension[name] = f
 }
 
+// GetFormat returns the format registered under name.
 func GetFormat(name string) (*Format, error) {
+	formatMu.RLock()
+	defer formatMu.RUnlock()
+
 	f, found := formatByExtension[name]
 	if !found {
 		return nil, fmt.Errorf("%s: %w", name, ErrUnknownFormat)
@@ -44,3 +110,23 @@ func GetFormat(name string) (*Format, error) {
 
 	return &f, nil
 }
+
+// Formats returns the names of all registered formats, sorted.
+func Formats() []string {
+	formatMu.RLock()
+	defer formatMu.RUnlock()
+
+	names := polyfill.MapsKeys(formatByExtension)
+	polyfill.SlicesSort(names)
+
+	return names
+}
+
+func isFormat(name string) bool {
+	formatMu.RLock()
+	defer formatMu.RUnlock()
+
+	_, found := formatByExtension[name]
+
+	return found
+}
@@ -0,0 +1,59 @@
+package bkl_test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gopatchy/bkl"
+	"github.com/stretchr/testify/require"
+)
+
+// kvFormat is a minimal single-document key=value format.
+var kvFormat = bkl.Format{
+	MarshalStream: func(docs []any) ([]byte, error) {
+		lines := []string{}
+
+		for _, doc := range docs {
+			for k, v := range doc.(map[string]any) {
+				lines = append(lines, fmt.Sprintf("%s=%v", k, v))
+			}
+		}
+
+		sort.Strings(lines)
+
+		return []byte(strings.Join(lines, "\n") + "\n"), nil
+	},
+	UnmarshalStream: func(in []byte) ([]any, error) {
+		doc := map[string]any{}
+
+		for _, line := range strings.Split(strings.TrimSpace(string(in)), "\n") {
+			k, v, _ := strings.Cut(line, "=")
+			doc[k] = v
+		}
+
+		return []any{doc}, nil
+	},
+}
+
+func TestRegisterFormat(t *testing.T) {
+	t.Parallel()
+
+	bkl.RegisterFormat("kv", kvFormat)
+
+	require.Contains(t, bkl.Formats(), "kv")
+
+	realPath, format, err := bkl.FileMatch("tests/format-kv/a.b.kv")
+	require.NoError(t, err)
+	require.Equal(t, "tests/format-kv/a.b.yaml", realPath)
+	require.Equal(t, "kv", format)
+
+	b := bkl.New()
+
+	require.NoError(t, b.MergeFileLayers(realPath))
+
+	blob, err := b.Output(format)
+	require.NoError(t, err)
+	require.Equal(t, "a=1\nb=3\nc=x=y\n\n", string(blob))
+}
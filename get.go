@@ -7,23 +7,39 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-func get(doc *Document, docs []*Document, m any) (any, error) {
+// getRef resolves reference m, returning the document and key path that it
+// refers to and the value found there.
+func getRef(doc *Document, docs []*Document, m any) (*Document, []string, any, error) {
+	doc, path, err := getDocPath(doc, docs, m)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	ret, err := getPath(doc.Data, path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return doc, path, ret, nil
+}
+
+func getDocPath(doc *Document, docs []*Document, m any) (*Document, []string, error) {
 	switch m2 := m.(type) {
 	case string:
-		return getPathFromString(doc.Data, docs, m2)
+		return getDocPathFromString(doc, docs, m2)
 
 	case []any:
-		return getPathFromList(doc.Data, docs, m2)
+		return getDocPathFromList(doc, docs, m2)
 
 	case map[string]any:
-		return getCross(docs, m2)
+		return getCross(doc, docs, m2)
 
 	default:
-		return nil, fmt.Errorf("%T as reference: %w", m, ErrInvalidType)
+		return nil, nil, fmt.Errorf("%T as reference: %w", m, ErrInvalidType)
 	}
 }
 
-func getPathFromList(obj any, docs []*Document, path []any) (any, error) {
+func getDocPathFromList(doc *Document, docs []*Document, path []any) (*Document, []string, error) {
 	if len(path) > 0 {
 		var pat any
 
@@ -36,40 +52,44 @@ func getPathFromList(obj any, docs []*Document, path []any) (any, error) {
 		if ok {
 			path = path[1:]
 
-			doc, err := getCrossDoc(docs, pat)
-			if err != nil {
-				return nil, err
+			var err error
+
+			if conf, ok := pat.(map[string]any); ok && conf["$import"] != nil {
+				doc, err = getImportDoc(doc, conf)
+			} else {
+				doc, err = getCrossDoc(docs, pat)
 			}
 
-			obj = doc.Data
+			if err != nil {
+				return nil, nil, err
+			}
 		}
 	}
 
 	path2, err := toStringList(path)
 	if err != nil {
-		return nil, fmt.Errorf("%v: %w", path, err)
+		return nil, nil, fmt.Errorf("%v: %w", path, err)
 	}
 
-	return getPath(obj, path2)
+	return doc, path2, nil
 }
 
-func getPathFromString(obj any, docs []*Document, path string) (any, error) {
+func getDocPathFromString(doc *Document, docs []*Document, path string) (*Document, []string, error) {
 	var path2 any
 	err := yaml.Unmarshal([]byte(path), &path2)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	switch path3 := path2.(type) {
 	case string:
-		parts := strings.Split(path3, ".")
-		return getPath(obj, parts)
+		return doc, strings.Split(path3, "."), nil
 
 	case []any:
-		return getPathFromList(obj, docs, path3)
+		return getDocPathFromList(doc, docs, path3)
 
 	default:
-		return nil, fmt.Errorf("%T as reference: %w", path2, ErrInvalidType)
+		return nil, nil, fmt.Errorf("%T as reference: %w", path2, ErrInvalidType)
 	}
 }
 
@@ -92,23 +112,30 @@ func getPath(obj any, parts []string) (any, error) {
 	}
 }
 
-func getCross(docs []*Document, conf map[string]any) (any, error) {
-	found, pat, _ := popMapValue(conf, "$match")
-	if !found {
-		return nil, fmt.Errorf("%#v: %w", conf, ErrMissingMatch)
+func getCross(doc *Document, docs []*Document, conf map[string]any) (*Document, []string, error) {
+	var err error
+
+	if _, found := conf["$import"]; found {
+		doc, err = getImportDoc(doc, conf)
+	} else {
+		found, pat, _ := popMapValue(conf, "$match")
+		if !found {
+			return nil, nil, fmt.Errorf("%#v: %w", conf, ErrMissingMatch)
+		}
+
+		doc, err = getCrossDoc(docs, pat)
 	}
 
-	doc, err := getCrossDoc(docs, pat)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	found, path, _ := popMapValue(conf, "$path")
 	if found {
-		return get(doc, docs, path)
+		return getDocPath(doc, docs, path)
 	}
 
-	return doc.Data, nil
+	return doc, []string{}, nil
 }
 
 func getCrossDoc(docs []*Document, pat any) (*Document, error) {
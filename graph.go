@@ -0,0 +1,162 @@
+package bkl
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/gopatchy/bkl/polyfill"
+)
+
+// A Graph is the file-level inheritance graph of a set of layers.
+type Graph struct {
+	// Files are all files in the graph, including parents outside the
+	// scanned paths and files read with $file or $import, in lexical order.
+	Files []string
+
+	// Edges link each file to its parents, in Files order and then parent
+	// order, followed by the files it reads.
+	Edges []GraphEdge
+}
+
+// A GraphEdge links File to one of its parents, or to a file it reads. Via is
+// how the parent was determined: "filename", "$parent", "glob" (a $parent
+// pattern) or "symlink" (by the filename of the symlink's target), or "$file"
+// or "$import" for files read with those directives.
+type GraphEdge struct {
+	File   string
+	Parent string
+	Via    string
+}
+
+// Graph scans the files in paths, the files in any directories in paths and
+// their subdirectories, and the parents of all of them, and returns how they
+// inherit from each other.
+func (p *Parser) Graph(paths ...string) (*Graph, error) {
+	files := []string{}
+
+	for _, path := range paths {
+		info, err := statFile(p.fsys, path)
+		if err != nil {
+			return nil, polyfill.ErrorsJoin(fmt.Errorf("%s: %w", path, ErrMissingFile), err)
+		}
+
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		found, err := p.findFiles(path)
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, found...)
+	}
+
+	g := p.scanLayers(files)
+
+	err := g.err()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Graph{
+		Files: g.files(),
+		Edges: []GraphEdge{},
+	}
+
+	for _, file := range ret.Files {
+		for _, ref := range g.edges(file) {
+			ret.Edges = append(ret.Edges, GraphEdge{
+				File:   file,
+				Parent: ref.path,
+				Via:    ref.via,
+			})
+		}
+	}
+
+	return ret, nil
+}
+
+// WriteDOT writes g in Graphviz DOT format, with edges from each file to its
+// parents labelled with how the parent was determined.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	b := &strings.Builder{}
+
+	b.WriteString("digraph bkl {\n")
+
+	for _, file := range g.Files {
+		fmt.Fprintf(b, "\t%s;\n", strconv.Quote(file))
+	}
+
+	for _, edge := range g.Edges {
+		fmt.Fprintf(b, "\t%s -> %s [label=%s];\n", strconv.Quote(edge.File), strconv.Quote(edge.Parent), strconv.Quote(edge.Via))
+	}
+
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+// WriteTree writes g as an indented text tree, starting from the files with
+// no parents, with each file's children indented below it. Files with several
+// parents appear below each of them. Loops that no such tree reaches start
+// from their first file.
+func (g *Graph) WriteTree(w io.Writer) error {
+	children := map[string][]GraphEdge{}
+	hasParent := map[string]bool{}
+
+	for _, edge := range g.Edges {
+		children[edge.Parent] = append(children[edge.Parent], edge)
+		hasParent[edge.File] = true
+	}
+
+	b := &strings.Builder{}
+	written := map[string]bool{}
+
+	var write func(edge GraphEdge, depth int, chain []string)
+
+	write = func(edge GraphEdge, depth int, chain []string) {
+		b.WriteString(strings.Repeat("  ", depth))
+		b.WriteString(edge.File)
+
+		written[edge.File] = true
+
+		if edge.Via != "" {
+			fmt.Fprintf(b, " (%s)", edge.Via)
+		}
+
+		if polyfill.SlicesContains(chain, edge.File) {
+			b.WriteString(" (loop)\n")
+			return
+		}
+
+		b.WriteString("\n")
+
+		chain = append(chain, edge.File)
+
+		for _, child := range children[edge.File] {
+			write(child, depth+1, chain)
+		}
+	}
+
+	for _, file := range g.Files {
+		if !hasParent[file] {
+			write(GraphEdge{File: file}, 0, nil)
+		}
+	}
+
+	for _, file := range g.Files {
+		if !written[file] {
+			write(GraphEdge{File: file}, 0, nil)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
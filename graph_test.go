@@ -0,0 +1,49 @@
+package bkl_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gopatchy/bkl"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraph(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	g, err := b.Graph("tests/graph-dirs/c")
+	require.NoError(t, err)
+	require.Equal(t, []string{"tests/graph-dirs/a.b.yaml", "tests/graph-dirs/a.yaml", "tests/graph-dirs/c/c.yaml", "tests/graph-dirs/v/one.yaml"}, g.Files)
+	require.Equal(t, []bkl.GraphEdge{
+		{File: "tests/graph-dirs/a.b.yaml", Parent: "tests/graph-dirs/a.yaml", Via: "filename"},
+		{File: "tests/graph-dirs/c/c.yaml", Parent: "tests/graph-dirs/a.b.yaml", Via: "$parent"},
+		{File: "tests/graph-dirs/c/c.yaml", Parent: "tests/graph-dirs/v/one.yaml", Via: "glob"},
+	}, g.Edges)
+
+	tree := &bytes.Buffer{}
+	require.NoError(t, g.WriteTree(tree))
+	require.Equal(t, `tests/graph-dirs/a.yaml
+  tests/graph-dirs/a.b.yaml (filename)
+    tests/graph-dirs/c/c.yaml ($parent)
+tests/graph-dirs/v/one.yaml
+  tests/graph-dirs/c/c.yaml (glob)
+`, tree.String())
+}
+
+func TestGraphTreeLoop(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	g, err := b.Graph("tests/parent-loop")
+	require.NoError(t, err)
+
+	tree := &bytes.Buffer{}
+	require.NoError(t, g.WriteTree(tree))
+	require.Equal(t, `tests/parent-loop/a.yaml
+  tests/parent-loop/b.yaml ($parent)
+    tests/parent-loop/a.yaml ($parent) (loop)
+`, tree.String())
+}
@@ -0,0 +1,229 @@
+package bkl
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/gopatchy/bkl/polyfill"
+)
+
+// imports maps the names given to files by $import to their processed
+// documents.
+type imports map[string][]*Document
+
+// clone returns a copy of is with copies of the documents, since processing
+// references to them modifies their data.
+func (is imports) clone() imports {
+	if is == nil {
+		return nil
+	}
+
+	ret := make(imports, len(is))
+
+	for name, docs := range is {
+		ret[name] = make([]*Document, len(docs))
+
+		for i, doc := range docs {
+			ret[name][i] = doc.clone()
+		}
+	}
+
+	return ret
+}
+
+// merge adds the imports in other, which come from a higher layer, replacing
+// any with the same names.
+func (is imports) merge(other imports) imports {
+	if len(other) == 0 {
+		return is
+	}
+
+	if is == nil {
+		is = imports{}
+	}
+
+	for name, docs := range other {
+		is[name] = docs
+	}
+
+	return is
+}
+
+// loadImports removes $import from doc, which was loaded from f, and loads
+// the files it names. $import is a path, a list of paths, or a map of names
+// to paths; paths are relative to f and without an extension, as for
+// $parent, and are named by their base name unless given a name. The paths
+// and contents of the files read and the $env values looked up by them are
+// written to key, for caching.
+func (p *Parser) loadImports(f *file, doc *Document, key io.Writer) (imports, error) {
+	found, val := doc.PopMapValue("$import")
+	if !found {
+		return nil, nil
+	}
+
+	paths, err := importPaths(val)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := imports{}
+
+	names := polyfill.MapsKeys(paths)
+	polyfill.SlicesSort(names)
+
+	for _, name := range names {
+		refs, err := f.toAbsolutePaths([]string{paths[name]})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ref := range refs {
+			docs, err := p.importFile(f, ref.path, key)
+			if err != nil {
+				return nil, err
+			}
+
+			ret[name] = append(ret[name], docs...)
+		}
+	}
+
+	return ret, nil
+}
+
+// importPaths returns the paths named by the $import value val, by name.
+// Paths in a list that have the same base name are an error, since only one
+// could be referenced.
+func importPaths(val any) (map[string]string, error) {
+	ret := map[string]string{}
+
+	switch val2 := val.(type) {
+	case string:
+		ret[filepath.Base(val2)] = val2
+
+	case []any:
+		list, err := toStringList(val2)
+		if err != nil {
+			return nil, fmt.Errorf("$import=%#v: %w", val2, err)
+		}
+
+		for _, path := range list {
+			name := filepath.Base(path)
+
+			if prev, found := ret[name]; found {
+				return nil, fmt.Errorf("$import=%#v: %s and %s are both named %s: %w", val2, prev, path, name, ErrInvalidArguments)
+			}
+
+			ret[name] = path
+		}
+
+	case map[string]any:
+		for name, v := range val2 {
+			path, ok := v.(string)
+			if !ok {
+				return nil, withKey(fmt.Errorf("%T: %w", v, ErrInvalidType), name)
+			}
+
+			ret[name] = path
+		}
+
+	default:
+		return nil, fmt.Errorf("$import=%T: %w", val, ErrInvalidType)
+	}
+
+	return ret, nil
+}
+
+// importFile merges the file at path, imported by f, with its parents in a
+// separate Parser and returns its processed documents. The paths and contents
+// of the files read and the $env values looked up are written to key.
+func (p *Parser) importFile(f *file, path string, key io.Writer) ([]*Document, error) {
+	chain := append(polyfill.SlicesClone(p.importing), f.path)
+
+	if polyfill.SlicesContains(chain, path) {
+		loop := append(chain, path)
+		return nil, fmt.Errorf("$import %s: %w", strings.Join(loop, " -> "), ErrCircularRef)
+	}
+
+	sub := &Parser{
+		fsys: p.fsys,
+		env: func(name string) (string, bool) {
+			v, found := p.env(name)
+			fmt.Fprintf(key, "%q=%q,%t ", name, v, found)
+
+			return v, found
+		},
+		debug:     p.debug,
+		cache:     p.cache,
+		importing: chain,
+	}
+
+	if p.envNames != nil {
+		sub.envNames = func() []string {
+			ret := p.envNames()
+			fmt.Fprintf(key, "%q ", ret)
+
+			return ret
+		}
+	}
+
+	err := sub.MergeFileLayers(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range sub.Files() {
+		raw, err := readFile(p.fsys, path, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(key, "%q=%q ", path, contentHash(raw))
+	}
+
+	f.includes = append(f.includes, sub.Files()...)
+
+	docs := sub.cloneDocs(false)
+	ret := []*Document{}
+
+	for i, doc := range docs {
+		obj, err := process(doc.Data, doc, docs, 0, nil, "")
+		if err != nil {
+			return nil, withDocument(annotateError(err, doc), path, i)
+		}
+
+		ret = append(ret, NewDocumentWithData(obj))
+	}
+
+	return ret, nil
+}
+
+// getImportDoc returns the document that doc imported with the name in
+// conf["$import"], which must be the only one unless conf has a $match
+// pattern to select it.
+func getImportDoc(doc *Document, conf map[string]any) (*Document, error) {
+	name, ok := conf["$import"].(string)
+	if !ok {
+		return nil, fmt.Errorf("$import=%T: %w", conf["$import"], ErrInvalidType)
+	}
+
+	var docs []*Document
+	if doc != nil {
+		docs = doc.imports[name]
+	}
+
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("$import=%s: %w", name, ErrRefNotFound)
+	}
+
+	if pat, found := conf["$match"]; found {
+		return getCrossDoc(docs, pat)
+	}
+
+	if len(docs) > 1 {
+		return nil, fmt.Errorf("$import=%s: %w", name, ErrMultiMatch)
+	}
+
+	return docs[0], nil
+}
@@ -0,0 +1,45 @@
+package bkl_test
+
+import (
+	"testing"
+
+	"github.com/gopatchy/bkl"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImport(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	require.NoError(t, b.MergeFileLayers("tests/import-match/a.b.yaml"))
+	require.Equal(t, []string{"tests/import-match/a.yaml", "tests/import-match/lib/snippets.yaml", "tests/import-match/a.b.yaml"}, b.Files())
+	require.Len(t, b.Documents(), 1)
+
+	blob, err := b.Output("json")
+	require.NoError(t, err)
+	require.Equal(t, `{"a":1,"logging":"info","metrics":9090}
+`, string(blob))
+
+	b = bkl.New()
+	require.NoError(t, b.MergeFileLayers("tests/import-match/c.yaml"))
+
+	_, err = b.Output("json")
+	require.ErrorIs(t, err, bkl.ErrMultiMatch)
+
+	b = bkl.New()
+	require.NoError(t, b.MergeFileLayers("tests/import-match/d.yaml"))
+
+	_, err = b.Output("json")
+	require.ErrorIs(t, err, bkl.ErrRefNotFound)
+}
+
+func TestImportCollision(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	err := b.MergeFileLayers("tests/import-collision/a.yaml")
+	require.ErrorIs(t, err, bkl.ErrInvalidArguments)
+	require.ErrorContains(t, err, "x/log and y/log are both named log")
+}
@@ -0,0 +1,216 @@
+package bkl
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gopatchy/bkl/polyfill"
+)
+
+// A literal is the contents of a file read by $file. It's kept distinct from
+// strings in layers so that processing doesn't interpret the contents as
+// directives or $interp references, and converted to a string at output
+// (see unliteral).
+type literal string
+
+// A readFunc reads the file at path, relative to the layer being loaded, and
+// returns an error if it's larger than limit bytes (if limit > 0).
+type readFunc func(path string, limit int64) ([]byte, error)
+
+// include replaces $file directives in obj with the contents of the files
+// they name.
+func include(obj any, read readFunc) (any, error) {
+	switch obj2 := obj.(type) {
+	case map[string]any:
+		if _, found := obj2["$file"]; found {
+			ret, err := includeValue(obj2, read)
+			if err != nil {
+				return nil, withDirective(err, "$file")
+			}
+
+			return ret, nil
+		}
+
+		return includeMap(obj2, read)
+
+	case []any:
+		return includeList(obj2, read)
+
+	case string:
+		if !strings.HasPrefix(obj2, "$file:") {
+			return obj2, nil
+		}
+
+		ret, err := includeFile(strings.TrimPrefix(obj2, "$file:"), false, false, 0, read)
+		if err != nil {
+			return nil, withDirective(err, "$file")
+		}
+
+		return ret, nil
+
+	default:
+		return obj2, nil
+	}
+}
+
+func includeMap(obj map[string]any, read readFunc) (map[string]any, error) {
+	return filterMap(obj, func(k string, v any) (map[string]any, error) {
+		v, err := include(v, read)
+		if err != nil {
+			return nil, withKey(err, k)
+		}
+
+		return map[string]any{k: v}, nil
+	})
+}
+
+func includeList(obj []any, read readFunc) ([]any, error) {
+	i := -1
+
+	return filterList(obj, func(v any) ([]any, error) {
+		i++
+
+		v, err := include(v, read)
+		if err != nil {
+			return nil, withIndex(err, i)
+		}
+
+		return []any{v}, nil
+	})
+}
+
+// includeValue resolves the map form of $file:
+//
+//	$file: path
+//	$base64: true  # base64-encode the contents
+//	$trim: true    # remove leading and trailing whitespace
+//	$limit: 4096   # maximum size in bytes
+func includeValue(obj map[string]any, read readFunc) (any, error) {
+	var (
+		path      string
+		b64, trim bool
+		limit     int64
+	)
+
+	for k, v := range obj {
+		switch k {
+		case "$file":
+			v2, ok := v.(string)
+			if !ok {
+				return nil, withKey(fmt.Errorf("%T: %w", v, ErrInvalidType), k)
+			}
+
+			path = v2
+
+		case "$base64", "$trim":
+			v2, ok := v.(bool)
+			if !ok {
+				return nil, withKey(fmt.Errorf("%T: %w", v, ErrInvalidType), k)
+			}
+
+			if k == "$base64" {
+				b64 = v2
+			} else {
+				trim = v2
+			}
+
+		case "$limit":
+			v2, ok := v.(int64)
+			if !ok || v2 <= 0 {
+				return nil, withKey(fmt.Errorf("%v: %w", v, ErrInvalidArguments), k)
+			}
+
+			limit = v2
+
+		default:
+			return nil, fmt.Errorf("%s: %w", k, ErrExtraKeys)
+		}
+	}
+
+	return includeFile(path, b64, trim, limit, read)
+}
+
+// includeFile returns the contents of path.
+func includeFile(path string, b64, trim bool, limit int64, read readFunc) (literal, error) {
+	raw, err := read(path, limit)
+	if err != nil {
+		return "", err
+	}
+
+	if trim {
+		raw = []byte(strings.TrimSpace(string(raw)))
+	}
+
+	if b64 {
+		return literal(base64.StdEncoding.EncodeToString(raw)), nil
+	}
+
+	if !utf8.Valid(raw) {
+		return "", fmt.Errorf("%s: not UTF-8 (use $base64): %w", path, ErrInvalidType)
+	}
+
+	return literal(raw), nil
+}
+
+// unliteral returns obj with every literal replaced by a string.
+func unliteral(obj any) any {
+	switch obj2 := obj.(type) {
+	case map[string]any:
+		ret := map[string]any{}
+
+		for k, v := range obj2 {
+			ret[k] = unliteral(v)
+		}
+
+		return ret
+
+	case []any:
+		ret := make([]any, len(obj2))
+
+		for i, v := range obj2 {
+			ret[i] = unliteral(v)
+		}
+
+		return ret
+
+	case literal:
+		return string(obj2)
+
+	default:
+		return obj
+	}
+}
+
+// includePaths returns the paths named by $file directives in obj, in the
+// order found.
+func includePaths(obj any) []string {
+	ret := []string{}
+
+	switch obj2 := obj.(type) {
+	case map[string]any:
+		if path, ok := obj2["$file"].(string); ok {
+			return append(ret, path)
+		}
+
+		keys := polyfill.MapsKeys(obj2)
+		polyfill.SlicesSort(keys)
+
+		for _, k := range keys {
+			ret = append(ret, includePaths(obj2[k])...)
+		}
+
+	case []any:
+		for _, v := range obj2 {
+			ret = append(ret, includePaths(v)...)
+		}
+
+	case string:
+		if strings.HasPrefix(obj2, "$file:") {
+			ret = append(ret, strings.TrimPrefix(obj2, "$file:"))
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,159 @@
+package bkl
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// interpEscapeRE matches a run of "$" before "(".
+var interpEscapeRE = regexp.MustCompile(`\$+\(`)
+
+// interpolate replaces each "$(ref)" in s with the result of fn(ref). If fn
+// returns false, the reference is left as-is.
+//
+// In a run of "$" before "(", each "$$" is an escaped "$", and a remaining
+// "$" starts a reference: "$$(x)" is a literal "$(x)" and "$$$(x)" is "$"
+// followed by x. If unescape is false, escaped runs are left as-is so that
+// they can be resolved by a later pass.
+func interpolate(s string, unescape bool, fn func(ref string) (string, bool, error)) (string, error) {
+	if !strings.Contains(s, "$(") {
+		return s, nil
+	}
+
+	b := &strings.Builder{}
+	rest := s
+
+	for {
+		i := strings.Index(rest, "$(")
+		if i == -1 {
+			b.WriteString(rest)
+			return b.String(), nil
+		}
+
+		start := i
+		for start > 0 && rest[start-1] == '$' {
+			start--
+		}
+
+		n := i + 1 - start
+
+		b.WriteString(rest[:start])
+
+		if unescape {
+			b.WriteString(strings.Repeat("$", n/2))
+		} else {
+			b.WriteString(strings.Repeat("$", n-n%2))
+		}
+
+		// rest starts at "("
+		rest = rest[i+1:]
+
+		if n%2 == 0 {
+			b.WriteString("(")
+			rest = rest[1:]
+
+			continue
+		}
+
+		end := interpEnd(rest[1:])
+		if end == -1 {
+			return "", fmt.Errorf("%s: unterminated $(: %w", s, ErrInvalidArguments)
+		}
+
+		ref := rest[1 : 1+end]
+
+		val, ok, err := fn(ref)
+		if err != nil {
+			return "", withDirective(err, "$("+ref+")")
+		}
+
+		if ok {
+			b.WriteString(val)
+		} else {
+			b.WriteString("$(" + ref + ")")
+		}
+
+		rest = rest[1+end+1:]
+	}
+}
+
+// escapeInterp returns s with every "$" before "(" doubled, so that
+// interpolate with unescape returns s unchanged.
+func escapeInterp(s string) string {
+	return interpEscapeRE.ReplaceAllStringFunc(s, func(m string) string {
+		dollars := m[:len(m)-1]
+		return dollars + dollars + "("
+	})
+}
+
+// interpEnd returns the index of the ")" that closes a reference starting at
+// the beginning of s, or -1.
+func interpEnd(s string) int {
+	depth := 0
+
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+
+		case ')':
+			if depth == 0 {
+				return i
+			}
+
+			depth--
+		}
+	}
+
+	return -1
+}
+
+// processStringInterp resolves "$interp:<string>", replacing "$(ref)"
+// references in the string with the values they refer to, as for $merge.
+func processStringInterp(obj string, mergeFrom *Document, mergeFromDocs []*Document, depth int) (string, error) {
+	ret, err := interpolate(strings.TrimPrefix(obj, "$interp:"), true, func(ref string) (string, bool, error) {
+		doc, _, in, err := getRef(mergeFrom, mergeFromDocs, ref)
+		if err != nil {
+			return "", false, err
+		}
+
+		v, err := process(in, doc, mergeFromDocs, depth, nil, "")
+		if err != nil {
+			return "", false, err
+		}
+
+		ret, err := interpString(v)
+		if err != nil {
+			return "", false, fmt.Errorf("%s: %w", ref, err)
+		}
+
+		return ret, true, nil
+	})
+	if err != nil {
+		return "", withDirective(err, "$interp")
+	}
+
+	return ret, nil
+}
+
+// interpString returns the text of the scalar v for interpolation.
+func interpString(v any) (string, error) {
+	switch v2 := v.(type) {
+	case string:
+		if v2 == "$required" {
+			return "", ErrRequiredField
+		}
+
+		return v2, nil
+
+	case literal:
+		return string(v2), nil
+
+	case map[string]any, []any, nil:
+		return "", fmt.Errorf("%T: %w", v, ErrInvalidType)
+
+	default:
+		return fmt.Sprint(v2), nil
+	}
+}
@@ -38,6 +38,7 @@ func jsonMarshalStreamPretty(vs []any) ([]byte, error) {
 
 func jsonUnmarshalStream(in []byte) ([]any, error) {
 	dec := json.NewDecoder(bytes.NewReader(in))
+	dec.UseNumber()
 	ret := []any{}
 
 	for {
@@ -55,3 +56,74 @@ func jsonUnmarshalStream(in []byte) ([]any, error) {
 
 	return ret, nil
 }
+
+func jsonUnmarshalStreamPositions(in []byte) ([]any, []positions, error) {
+	docs, err := jsonUnmarshalStream(in)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(in))
+	li := newLineIndex(in)
+	poss := []positions{}
+
+	for dec.More() {
+		ps := positions{}
+
+		err = jsonPositions(dec, in, li, "", ps)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		poss = append(poss, ps)
+	}
+
+	return docs, poss, nil
+}
+
+func jsonPositions(dec *json.Decoder, in []byte, li lineIndex, path string, ps positions) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return nil
+	}
+
+	for i := 0; dec.More(); i++ {
+		start := jsonSkip(in, int(dec.InputOffset()))
+		subPath := indexPath(path, i)
+
+		if delim == '{' {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+
+			subPath = keyPath(path, toString(key))
+		}
+
+		ps.add(subPath, li.position(start))
+
+		err = jsonPositions(dec, in, li, subPath, ps)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Closing delimiter
+	_, err = dec.Token()
+
+	return err
+}
+
+// jsonSkip returns the offset of the next token at or after offset.
+func jsonSkip(in []byte, offset int) int {
+	for offset < len(in) && bytes.IndexByte([]byte(" \t\r\n,:"), in[offset]) != -1 {
+		offset++
+	}
+
+	return offset
+}
@@ -1,6 +1,8 @@
 package bkl
 
 import (
+	"math"
+	"math/big"
 	"strings"
 )
 
@@ -17,7 +19,7 @@ func match(obj any, pat any) bool {
 		return matchList(obj, pat2)
 
 	default:
-		return obj == pat
+		return equal(obj, pat)
 	}
 }
 
@@ -68,3 +70,50 @@ func matchListSingle(obj []any, pat any) bool {
 
 	return false
 }
+
+// equal returns whether the scalar values a and b are the same. Numbers are
+// compared by value regardless of type, DateTimes with DateTime.Equal, and
+// literals by their string value.
+func equal(a, b any) bool {
+	if l, ok := a.(literal); ok {
+		a = string(l)
+	}
+
+	if l, ok := b.(literal); ok {
+		b = string(l)
+	}
+
+	if dt, ok := a.(DateTime); ok {
+		other, ok := b.(DateTime)
+		return ok && dt.Equal(other)
+	}
+
+	aNum, aOK := toBigFloat(a)
+	bNum, bOK := toBigFloat(b)
+
+	if aOK || bOK {
+		return aOK && bOK && aNum.Cmp(bNum) == 0
+	}
+
+	return a == b
+}
+
+// toBigFloat returns the exact value of the number v.
+func toBigFloat(v any) (*big.Float, bool) {
+	switch v2 := v.(type) {
+	case int:
+		return new(big.Float).SetInt64(int64(v2)), true
+	case int64:
+		return new(big.Float).SetInt64(v2), true
+	case uint64:
+		return new(big.Float).SetUint64(v2), true
+	case float64:
+		if math.IsNaN(v2) {
+			return nil, false
+		}
+
+		return new(big.Float).SetFloat64(v2), true
+	default:
+		return nil, false
+	}
+}
@@ -5,47 +5,96 @@ import (
 )
 
 func mergeDocs(doc, patch *Document) error {
-	merged, err := merge(doc.Data, patch.Data)
+	// Must remap before merge() modifies the data
+	poss := patch.positions.remap(doc.Data, patch.Data)
+	cmts := patch.comments.remap(doc.Data, patch.Data)
+
+	// patch has provenance and key order tables if the Parser records them
+	if patch.provenance != nil && doc.provenance == nil {
+		doc.provenance = newProvenance(doc.Data, doc.sourceAt)
+	}
+
+	if patch.keys != nil && doc.keys == nil {
+		doc.keys = newKeyOrder(doc.Data, doc.positions)
+	}
+
+	rec := &recorder{
+		source: patch.sourceAt,
+		order:  patch.keys.at,
+	}
+
+	if patch.provenance != nil {
+		rec.prov = doc.provenance
+	}
+
+	if patch.keys != nil {
+		rec.keys = doc.keys
+	}
+
+	merged, err := merge(doc.Data, patch.Data, rec, "", "")
 	if err != nil {
-		return err
+		return annotateMergeError(err, patch, doc)
+	}
+
+	if doc.positions == nil {
+		doc.positions = positions{}
 	}
 
 	doc.Data = merged
+	doc.positions.merge(poss)
+
+	if len(cmts) > 0 {
+		if doc.comments == nil {
+			doc.comments = comments{}
+		}
+
+		doc.comments.merge(cmts)
+	}
+
+	doc.imports = doc.imports.merge(patch.imports)
+
 	patch.Parents = append(patch.Parents, doc)
 
 	return nil
 }
 
-func merge(dst any, src any) (any, error) {
+// merge merges src into dst, recording the source of changed values in rec
+// (which may be nil). dstPath and srcPath are the key paths of dst and src
+// within their documents.
+func merge(dst any, src any, rec *recorder, dstPath, srcPath string) (any, error) {
 	switch dst2 := dst.(type) {
 	case map[string]any:
-		return mergeMap(dst2, src)
+		return mergeMap(dst2, src, rec, dstPath, srcPath)
 
 	case []any:
-		return mergeList(dst2, src)
+		return mergeList(dst2, src, rec, dstPath, srcPath)
 
 	case nil:
+		rec.set(dstPath, srcPath, src)
 		return src, nil
 
 	default:
-		if src == dst {
+		if equal(src, dst) {
 			return nil, fmt.Errorf("%#v: %w", src, ErrUselessOverride)
 		}
 
+		rec.set(dstPath, srcPath, src)
+
 		return src, nil
 	}
 }
 
-func mergeMap(dst map[string]any, src any) (any, error) {
+func mergeMap(dst map[string]any, src any, rec *recorder, dstPath, srcPath string) (any, error) {
 	switch src2 := src.(type) {
 	case map[string]any:
-		return mergeMapMap(dst, src2)
+		return mergeMapMap(dst, src2, rec, dstPath, srcPath)
 
 	case nil:
 		return dst, nil
 
 	default:
 		if len(dst) == 0 {
+			rec.set(dstPath, srcPath, src)
 			return src, nil
 		}
 
@@ -53,46 +102,53 @@ func mergeMap(dst map[string]any, src any) (any, error) {
 	}
 }
 
-func mergeMapMap(dst map[string]any, src map[string]any) (map[string]any, error) {
+func mergeMapMap(dst map[string]any, src map[string]any, rec *recorder, dstPath, srcPath string) (map[string]any, error) {
 	replace, found := getMapBoolValue(src, "$replace")
 	if found && replace {
 		delete(src, "$replace")
+		rec.set(dstPath, srcPath, src)
 
 		return src, nil
 	}
 
 	for k, v := range src {
 		existing, found := dst[k]
+		kDstPath := keyPath(dstPath, k)
+		kSrcPath := keyPath(srcPath, k)
 
 		if toString(v) == "$delete" {
 			if !found {
-				return nil, fmt.Errorf("%s=null: %w", k, ErrUselessOverride)
+				return nil, withKey(fmt.Errorf("$delete: %w", ErrUselessOverride), k)
 			}
 
 			delete(dst, k)
+			rec.remove(kDstPath)
 
 			continue
 		}
 
 		if found {
-			v2, err := merge(existing, v)
+			v2, err := merge(existing, v, rec, kDstPath, kSrcPath)
 			if err != nil {
-				return nil, fmt.Errorf("%s %w", k, err)
+				return nil, withKey(err, k)
 			}
 
 			dst[k] = v2
 		} else {
 			dst[k] = v
+			rec.set(kDstPath, kSrcPath, v)
 		}
 	}
 
+	rec.touch(dstPath, srcPath)
+
 	return dst, nil
 }
 
-func mergeList(dst []any, src any) (any, error) {
+func mergeList(dst []any, src any, rec *recorder, dstPath, srcPath string) (any, error) {
 	switch src2 := src.(type) {
 	case []any:
-		return mergeListList(dst, src2)
+		return mergeListList(dst, src2, rec, dstPath, srcPath)
 
 	case nil:
 		return dst, nil
@@ -102,9 +158,13 @@ func mergeList(dst []any, src any) (any, error) {
 	}
 }
 
-func mergeListList(dst []any, src []any) ([]any, error) {
+func mergeListList(dst []any, src []any, rec *recorder, dstPath, srcPath string) ([]any, error) {
+	// Indexes of the remaining entries within the original src
+	srcIdx := keptIndexes(keepList(src, func(v any) bool { return !isListReplace(v) }))
+
 	replace, src := popListString(src, "$replace")
 	if replace {
+		mergeListReplaced(src, srcIdx, rec, dstPath, srcPath)
 		return src, nil
 	}
 
@@ -114,27 +174,33 @@ func mergeListList(dst []any, src []any) ([]any, error) {
 	}
 
 	if replace {
+		mergeListReplaced(src, srcIdx, rec, dstPath, srcPath)
 		return src, nil
 	}
 
+	rec.filter(dstPath, keepList(dst, func(v any) bool { return v != "$required" }))
 	_, dst = popListString(dst, "$required")
 
-	for _, v := range src {
+	for i, v := range src {
+		vSrcPath := indexPath(srcPath, srcIdx[i])
+
 		vMap, ok := v.(map[string]any)
 		if !ok {
 			dst = append(dst, v)
+			rec.set(indexPath(dstPath, len(dst)-1), vSrcPath, v)
+
 			continue
 		}
 
 		found, del, vMap := popMapValue(vMap, "$delete")
 		if found {
 			if len(vMap) > 0 {
-				return nil, fmt.Errorf("%#v: %w", vMap, ErrExtraKeys)
+				return nil, withIndex(fmt.Errorf("%#v: %w", vMap, ErrExtraKeys), i)
 			}
 
-			dst, err = mergeListDelete(dst, del)
+			dst, err = mergeListDelete(dst, del, rec, dstPath)
 			if err != nil {
-				return nil, err
+				return nil, withIndex(withKey(err, "$delete"), i)
 			}
 
 			continue
@@ -142,25 +208,51 @@ func mergeListList(dst []any, src []any) ([]any, error) {
 
 		found, m, vMap := popMapValue(vMap, "$match")
 		if found {
-			dst, err = mergeListMatch(dst, m, vMap)
+			dst, err = mergeListMatch(dst, m, vMap, rec, dstPath, vSrcPath)
 			if err != nil {
-				return nil, err
+				return nil, withIndex(err, i)
 			}
 
 			continue
 		}
 
 		dst = append(dst, v)
+		rec.set(indexPath(dstPath, len(dst)-1), vSrcPath, v)
 	}
 
+	rec.touch(dstPath, srcPath)
+
 	return dst, nil
 }
 
-func mergeListDelete(obj []any, del any) ([]any, error) {
+// isListReplace returns whether v is a "$replace" or {$replace: true} entry.
+func isListReplace(v any) bool {
+	if v == "$replace" {
+		return true
+	}
+
+	vMap, ok := v.(map[string]any)
+
+	return ok && hasMapBoolValue(vMap, "$replace", true)
+}
+
+// mergeListReplaced records the entries of src replacing the list at dstPath.
+func mergeListReplaced(src []any, srcIdx []int, rec *recorder, dstPath, srcPath string) {
+	rec.remove(dstPath)
+	rec.touch(dstPath, srcPath)
+
+	for i, v := range src {
+		rec.set(indexPath(dstPath, i), indexPath(srcPath, srcIdx[i]), v)
+	}
+}
+
+func mergeListDelete(obj []any, del any, rec *recorder, path string) ([]any, error) {
 	var err error
 
 	deleted := false
 
+	rec.filter(path, keepList(obj, func(v any) bool { return !match(v, del) }))
+
 	obj, err = filterList(obj, func(v any) ([]any, error) {
 		if match(v, del) {
 			deleted = true
@@ -181,9 +273,12 @@ func mergeListDelete(obj []any, del any) ([]any, error) {
 	return obj, nil
 }
 
-func mergeListMatch(obj []any, m any, v map[string]any) ([]any, error) {
+func mergeListMatch(obj []any, m any, v map[string]any, rec *recorder, dstPath, srcPath string) ([]any, error) {
 	var val any = v
 
+	valKey := ""
+	i := -1
+
 	found, v2, v := popMapValue(v, "$value")
 	if found {
 		if len(v) > 0 {
@@ -191,16 +286,24 @@ func mergeListMatch(obj []any, m any, v map[string]any) ([]any, error) {
 		}
 
 		val = v2
+		valKey = "$value"
+		srcPath = keyPath(srcPath, valKey)
 	}
 
 	found = false
 
 	obj, err := filterList(obj, func(v2 any) ([]any, error) {
+		i++
+
 		if match(v2, m) {
 			found = true
 
-			v2, err := merge(v2, val)
+			v2, err := merge(v2, val, rec, indexPath(dstPath, i), srcPath)
 			if err != nil {
+				if valKey != "" {
+					err = withKey(err, valKey)
+				}
+
 				return nil, err
 			}
 
@@ -214,7 +317,7 @@ func mergeListMatch(obj []any, m any, v map[string]any) ([]any, error) {
 	}
 
 	if !found {
-		return nil, fmt.Errorf("%#v: %w", m, ErrNoMatchFound)
+		return nil, withKey(fmt.Errorf("%#v: %w", m, ErrNoMatchFound), "$match")
 	}
 
 	return obj, nil
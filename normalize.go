@@ -1,7 +1,13 @@
 package bkl
 
 import (
+	"encoding/json"
 	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
 )
 
 func normalize(obj any) (any, error) {
@@ -18,11 +24,54 @@ func normalize(obj any) (any, error) {
 	case []any:
 		return normalizeList(obj2)
 
+	case int:
+		return int64(obj2), nil
+
+	case json.Number:
+		return normalizeNumber(obj2)
+
+	case time.Time:
+		return newDateTime(obj2), nil
+
+	case toml.LocalDate:
+		return DateTime{Time: obj2.AsTime(time.UTC), HasDate: true}, nil
+
+	case toml.LocalTime:
+		return DateTime{Time: time.Date(0, 1, 1, obj2.Hour, obj2.Minute, obj2.Second, obj2.Nanosecond, time.UTC), HasTime: true}, nil
+
+	case toml.LocalDateTime:
+		return DateTime{Time: obj2.AsTime(time.UTC), HasDate: true, HasTime: true}, nil
+
 	default:
 		return obj2, nil
 	}
 }
 
+// normalizeNumber converts n to int64, or uint64 if it's too large, if it's an
+// integer, and to float64 otherwise, so numbers from every format compare
+// equal. Integers too large for uint64 are an error rather than losing
+// precision as float64.
+func normalizeNumber(n json.Number) (any, error) {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		return i, nil
+	}
+
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		return u, nil
+	}
+
+	if _, ok := new(big.Int).SetString(string(n), 10); ok {
+		return nil, fmt.Errorf("%s: integer out of range: %w", n, ErrInvalidType)
+	}
+
+	f, err := n.Float64()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", n, ErrInvalidType)
+	}
+
+	return f, nil
+}
+
 func normalizeListMap(obj []map[string]any) ([]any, error) {
 	obj2 := []any{}
 
@@ -37,7 +86,7 @@ func normalizeMap(obj map[string]any) (map[string]any, error) {
 	return filterMap(obj, func(k string, v any) (map[string]any, error) {
 		v2, err := normalize(v)
 		if err != nil {
-			return nil, err
+			return nil, withKey(err, k)
 		}
 
 		return map[string]any{k: v2}, nil
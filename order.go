@@ -0,0 +1,329 @@
+package bkl
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+
+	"github.com/gopatchy/bkl/polyfill"
+	"gopkg.in/yaml.v3"
+)
+
+// keyOrder maps the key paths of maps within a document (e.g. "a.b[2]", or
+// "" for the root) to their keys in source order: the order they were first
+// seen in the lowest layer, followed by keys added by higher layers in the
+// order they appear there.
+type keyOrder struct {
+	pathMap[[]string]
+}
+
+// newKeyOrder returns the key order of the maps in obj, as found at ps. Keys
+// without positions follow the others, sorted.
+func newKeyOrder(obj any, ps positions) *keyOrder {
+	ret := &keyOrder{newPathMap[[]string]()}
+	ret.scan(obj, "", ps)
+
+	return ret
+}
+
+func (ko *keyOrder) scan(obj any, path string, ps positions) {
+	switch obj2 := obj.(type) {
+	case map[string]any:
+		keys := polyfill.MapsKeys(obj2)
+		polyfill.SlicesSort(keys)
+
+		pos := func(k string) (Position, bool) {
+			poss := ps[keyPath(path, k)]
+			if len(poss) == 0 {
+				return Position{}, false
+			}
+
+			return poss[0], true
+		}
+
+		sort.SliceStable(keys, func(i, j int) bool {
+			posI, okI := pos(keys[i])
+			posJ, okJ := pos(keys[j])
+
+			if !okI || !okJ {
+				return okI && !okJ
+			}
+
+			return posI.Line < posJ.Line || (posI.Line == posJ.Line && posI.Column < posJ.Column)
+		})
+
+		ko.set(path, keys)
+
+		for k, v := range obj2 {
+			ko.scan(v, keyPath(path, k), ps)
+		}
+
+	case []any:
+		for i, v := range obj2 {
+			ko.scan(v, indexPath(path, i), ps)
+		}
+	}
+}
+
+// at returns the keys recorded for the map at path, or nil if there are none
+// (or ko is nil).
+func (ko *keyOrder) at(path string) []string {
+	if ko == nil {
+		return nil
+	}
+
+	keys, _ := ko.get(path)
+
+	return keys
+}
+
+func (ko *keyOrder) clone() *keyOrder {
+	ret := &keyOrder{ko.pathMap.clone()}
+
+	for path, keys := range ret.vals {
+		ret.vals[path] = polyfill.SlicesClone(keys)
+	}
+
+	return ret
+}
+
+func (ko *keyOrder) add(path string, keys []string) {
+	existing := ko.at(path)
+
+	seen := map[string]bool{}
+	for _, k := range existing {
+		seen[k] = true
+	}
+
+	for _, k := range keys {
+		if !seen[k] {
+			existing = append(existing, k)
+			seen[k] = true
+		}
+	}
+
+	ko.set(path, existing)
+}
+
+// apply returns obj, which is at path, with maps replaced by orderedMaps in
+// the order recorded in ko, carrying the comments in cs. Keys that ko doesn't
+// know follow, sorted.
+func (ko *keyOrder) apply(obj any, path string, cs comments) any {
+	ret := ko.applyMaps(obj, path, cs)
+
+	if om, ok := ret.(*orderedMap); ok && path == "" {
+		om.comment = cs[""]
+	}
+
+	return ret
+}
+
+func (ko *keyOrder) applyMaps(obj any, path string, cs comments) any {
+	switch obj2 := obj.(type) {
+	case map[string]any:
+		ret := &orderedMap{
+			keys: ko.sortKeys(obj2, path),
+			vals: map[string]any{},
+		}
+
+		for k, v := range obj2 {
+			subPath := keyPath(path, k)
+			ret.vals[k] = ko.applyMaps(v, subPath, cs)
+
+			if c, found := cs[subPath]; found {
+				if ret.comments == nil {
+					ret.comments = map[string]comment{}
+				}
+
+				ret.comments[k] = c
+			}
+		}
+
+		return ret
+
+	case []any:
+		ret := make([]any, len(obj2))
+
+		for i, v := range obj2 {
+			ret[i] = ko.applyMaps(v, indexPath(path, i), cs)
+		}
+
+		return ret
+
+	default:
+		return obj
+	}
+}
+
+// sortKeys returns the keys of obj, which is at path, in the order recorded
+// in ko. Keys that ko doesn't know follow, sorted.
+func (ko *keyOrder) sortKeys(obj map[string]any, path string) []string {
+	ret := []string{}
+	seen := map[string]bool{}
+
+	for _, k := range ko.at(path) {
+		if _, found := obj[k]; found && !seen[k] {
+			ret = append(ret, k)
+			seen[k] = true
+		}
+	}
+
+	rest := []string{}
+
+	for k := range obj {
+		if !seen[k] {
+			rest = append(rest, k)
+		}
+	}
+
+	polyfill.SlicesSort(rest)
+
+	return append(ret, rest...)
+}
+
+// An orderedMap is a map with its keys in output order and the comments
+// attached to them (and, for the document root, to the map itself). They are
+// produced by keyOrder.apply for marshaling by the built-in formats only.
+type orderedMap struct {
+	keys     []string
+	vals     map[string]any
+	comments map[string]comment
+	comment  comment
+}
+
+func (om *orderedMap) MarshalJSON() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteString("{")
+
+	for i, k := range om.keys {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+
+		key, err := json.Marshal(k)
+		if err != nil {
+			return nil, err
+		}
+
+		val, err := json.Marshal(om.vals[k])
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(key)
+		buf.WriteString(":")
+		buf.Write(val)
+	}
+
+	buf.WriteString("}")
+
+	return buf.Bytes(), nil
+}
+
+func (om *orderedMap) MarshalYAML() (any, error) {
+	node := &yaml.Node{
+		Kind:        yaml.MappingNode,
+		HeadComment: om.comment.head,
+		FootComment: om.comment.foot,
+	}
+
+	for _, k := range om.keys {
+		key := &yaml.Node{}
+
+		err := key.Encode(k)
+		if err != nil {
+			return nil, err
+		}
+
+		c := om.comments[k]
+		key.HeadComment = c.head
+		key.LineComment = c.line
+		key.FootComment = c.foot
+
+		val, err := yamlNode(om.vals[k])
+		if err != nil {
+			return nil, err
+		}
+
+		node.Content = append(node.Content, key, val)
+	}
+
+	return node, nil
+}
+
+// yamlNode encodes v as a yaml.Node. orderedMaps are converted directly,
+// since encoding them with Node.Encode drops the comments on their keys.
+func yamlNode(v any) (*yaml.Node, error) {
+	switch v2 := v.(type) {
+	case *orderedMap:
+		node, err := v2.MarshalYAML()
+		if err != nil {
+			return nil, err
+		}
+
+		return node.(*yaml.Node), nil
+
+	case []any:
+		node := &yaml.Node{Kind: yaml.SequenceNode}
+
+		for _, item := range v2 {
+			child, err := yamlNode(item)
+			if err != nil {
+				return nil, err
+			}
+
+			node.Content = append(node.Content, child)
+		}
+
+		return node, nil
+
+	default:
+		node := &yaml.Node{}
+
+		err := node.Encode(v)
+		if err != nil {
+			return nil, err
+		}
+
+		return node, nil
+	}
+}
+
+// tomlPlain converts orderedMaps within obj to plain maps, and DateTimes to
+// the TOML encoder's date and time types.
+func tomlPlain(obj any) any {
+	switch obj2 := obj.(type) {
+	case *orderedMap:
+		ret := map[string]any{}
+
+		for _, k := range obj2.keys {
+			ret[k] = tomlPlain(obj2.vals[k])
+		}
+
+		return ret
+
+	case map[string]any:
+		ret := map[string]any{}
+
+		for k, v := range obj2 {
+			ret[k] = tomlPlain(v)
+		}
+
+		return ret
+
+	case []any:
+		ret := make([]any, len(obj2))
+
+		for i, v := range obj2 {
+			ret[i] = tomlPlain(v)
+		}
+
+		return ret
+
+	case DateTime:
+		return obj2.toml()
+
+	default:
+		return obj
+	}
+}
@@ -0,0 +1,61 @@
+package bkl_test
+
+import (
+	"testing"
+
+	"github.com/gopatchy/bkl"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceOrder(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+	b.SetSourceOrder(true)
+
+	require.NoError(t, b.MergeFileLayers("tests/key-order-merge/a.b.yaml"))
+
+	out, err := b.Output("json")
+	require.NoError(t, err)
+	require.Equal(t, `{"kind":"Deployment","apiVersion":"v1","metadata":{"name":"x","labels":{"z":1,"a":2,"m":3,"b":4},"annotations":{"y":1,"c":2}},"spec":[{"zeta":1,"alpha":2},{"omega":3,"beta":4}],"copy":{"first":0,"z":1,"a":2,"m":3,"b":4},"enc":"{\"q\":1,\"p\":2}\n"}
+`, string(out))
+
+	out, err = b.Output("yaml")
+	require.NoError(t, err)
+	require.Contains(t, string(out), "kind: Deployment\napiVersion: v1\nmetadata:\n  name: x\n  labels:\n    z: 1\n    a: 2\n")
+
+	out, err = b.Output("toml")
+	require.NoError(t, err)
+	require.Contains(t, string(out), "kind = 'Deployment'\napiVersion = 'v1'\n")
+	require.Contains(t, string(out), "z = 1\na = 2\nm = 3\nb = 4\n")
+
+	// Sorted by default
+	b.SetSourceOrder(false)
+	out, err = b.Output("json")
+	require.NoError(t, err)
+	require.Contains(t, string(out), `{"apiVersion":"v1","copy":{"a":2,`)
+
+	docs, err := b.OutputDocuments()
+	require.NoError(t, err)
+	require.IsType(t, map[string]any{}, docs[0])
+}
+
+func TestSourceOrderCache(t *testing.T) {
+	t.Parallel()
+
+	cache := bkl.NewCache()
+
+	b := bkl.New()
+	b.SetCache(cache)
+	require.NoError(t, b.MergeFileLayers("tests/key-order-cache/a.b.c.yaml"))
+
+	// Merges cached without source order aren't reused when recording it
+	b = bkl.New()
+	b.SetCache(cache)
+	b.SetSourceOrder(true)
+	require.NoError(t, b.MergeFileLayers("tests/key-order-cache/a.b.c.yaml"))
+
+	out, err := b.Output("json")
+	require.NoError(t, err)
+	require.Equal(t, "{\"z\":1,\"a\":2,\"b\":3,\"c\":4}\n", string(out))
+}
@@ -1,73 +1,75 @@
 package bkl
 
-import (
-	"github.com/gopatchy/bkl/polyfill"
-)
-
-func findOutputs(obj any) (any, []any, error) {
+// findOutputs returns obj without $output directives, and the $output
+// subtrees found within it along with their paths. Keys are visited in the
+// order given by keys, so outputs are found in that order.
+func findOutputs(obj any, keys *keyOrder, path string) (any, []any, []string, error) {
 	switch obj2 := obj.(type) {
 	case map[string]any:
-		return findOutputsMap(obj2)
+		return findOutputsMap(obj2, keys, path)
 
 	case []any:
-		return findOutputsList(obj2)
+		return findOutputsList(obj2, keys, path)
 
 	default:
-		return obj, []any{}, nil
+		return obj, []any{}, []string{}, nil
 	}
 }
 
-func findOutputsMap(obj map[string]any) (any, []any, error) {
+func findOutputsMap(obj map[string]any, keys *keyOrder, path string) (any, []any, []string, error) {
 	ret := map[string]any{}
 	outs := []any{}
+	paths := []string{}
 
 	output, obj := popMapBoolValue(obj, "$output", true)
 	if output {
 		outs = append(outs, ret)
+		paths = append(paths, path)
 	}
 
-	keys := polyfill.MapsKeys(obj)
-	polyfill.SlicesSort(keys)
-
-	for _, k := range keys {
+	for _, k := range keys.sortKeys(obj, path) {
 		v := obj[k]
 
-		vNew, subOuts, err := findOutputs(v)
+		vNew, subOuts, subPaths, err := findOutputs(v, keys, keyPath(path, k))
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 
 		outs = append(outs, subOuts...)
+		paths = append(paths, subPaths...)
 		ret[k] = vNew
 	}
 
-	return ret, outs, nil
+	return ret, outs, paths, nil
 }
 
-func findOutputsList(obj []any) (any, []any, error) {
+func findOutputsList(obj []any, keys *keyOrder, path string) (any, []any, []string, error) {
 	ret := []any{}
 	outs := []any{}
+	paths := []string{}
 
 	output, obj, err := popListMapBoolValue(obj, "$output", true)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	for _, v := range obj {
-		vNew, subOuts, err := findOutputs(v)
+	for i, v := range obj {
+		vNew, subOuts, subPaths, err := findOutputs(v, keys, indexPath(path, i))
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 
 		outs = append(outs, subOuts...)
+		paths = append(paths, subPaths...)
 		ret = append(ret, vNew)
 	}
 
 	if output {
 		outs = append(outs, any(ret))
+		paths = append(paths, path)
 	}
 
-	return ret, outs, nil
+	return ret, outs, paths, nil
 }
 
 func filterOutput(obj any) (any, error) {
@@ -8,8 +8,10 @@ package bkl
 import (
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/gopatchy/bkl/polyfill"
 )
@@ -32,6 +34,8 @@ import (
 //
 // Merge phase 2 (evaluate)
 //   - $env
+//   - $file
+//   - $import
 //
 // Merge phase 3 (merge)
 //   - $delete
@@ -41,6 +45,7 @@ import (
 //   - $merge
 //   - $replace: map
 //   - $replace: string
+//   - $interp
 //   - $encode
 //
 // Output phase 2 (output)
@@ -60,7 +65,32 @@ import (
 //   - If no parent documents -> append
 type Parser struct {
 	docs  []*Document
+	fsys  fs.FS
+	env   func(string) (string, bool)
 	debug bool
+	cache *Cache
+
+	// layers is the sequence of files merged by MergeFileLayers, if that is
+	// all that has been merged, so that later calls can continue from it.
+	layers *snapshot
+
+	// resume is set on Parsers made by Clone, whose MergeFileLayers calls
+	// continue from layers instead of merging those files again.
+	resume bool
+
+	// files are the paths of files read, in merge order.
+	files []string
+
+	// envNames lists the variables for $env prefixes, or is nil if they
+	// can't be listed.
+	envNames func() []string
+
+	// importing is the chain of files whose $import is being loaded, to
+	// detect cycles.
+	importing []string
+
+	provenance  bool
+	sourceOrder bool
 }
 
 // New creates and returns a new [Parser] with an empty starting document set.
@@ -68,7 +98,9 @@ type Parser struct {
 // New always succeeds and returns a Parser instance.
 func New() *Parser {
 	return &Parser{
-		debug: os.Getenv("BKL_DEBUG") != "",
+		env:      os.LookupEnv,
+		envNames: osEnvNames,
+		debug:    os.Getenv("BKL_DEBUG") != "",
 	}
 }
 
@@ -77,10 +109,118 @@ func (p *Parser) SetDebug(debug bool) {
 	p.debug = debug
 }
 
+// SetSourceOrder sets whether output maps have their keys in source order:
+// the order they first appear in the lowest layer that sets them, followed by
+// keys added by higher layers. By default, keys are sorted. Source order is
+// recorded as layers are merged, so SetSourceOrder must be enabled before
+// merging.
+func (p *Parser) SetSourceOrder(sourceOrder bool) {
+	p.sourceOrder = sourceOrder
+}
+
+// SetProvenance sets whether the layer that set each value is recorded as
+// layers are merged, for [Parser.Provenance] and [Parser.Blame]. Recording
+// costs time and memory proportional to the merged documents, so it's off by
+// default. SetProvenance must be called before merging.
+func (p *Parser) SetProvenance(provenance bool) {
+	p.provenance = provenance
+}
+
+// SetFS sets the filesystem that files, parents and globs are loaded from.
+// This allows layers embedded with [embed.FS] or held in other [fs.FS]
+// implementations to be merged. Paths are interpreted relative to the root of
+// fsys. Symlinks are only followed if fsys has a ReadLink method.
+//
+// A nil fsys (the default) loads from the real filesystem.
+func (p *Parser) SetFS(fsys fs.FS) {
+	p.fsys = fsys
+}
+
+// SetEnv sets the function used to look up variables for $env. It has the
+// same signature as [os.LookupEnv]. This allows each Parser to render with its
+// own variables without touching the process environment. $env is resolved
+// as files are loaded, so SetEnv must be called before merging.
+//
+// A nil lookup (the default) uses [os.LookupEnv]. Variables from any other
+// lookup can't be listed, so $env prefixes (e.g. "APP_*") are an error; use
+// [Parser.SetEnvMap] instead.
+func (p *Parser) SetEnv(lookup func(key string) (string, bool)) {
+	p.env = lookup
+	p.envNames = nil
+
+	if lookup == nil {
+		p.env = os.LookupEnv
+		p.envNames = osEnvNames
+	}
+}
+
+// SetEnvMap sets the variables available to $env to exactly those in env.
+// The process environment is not consulted.
+func (p *Parser) SetEnvMap(env map[string]string) {
+	p.SetEnv(func(key string) (string, bool) {
+		v, found := env[key]
+		return v, found
+	})
+
+	p.envNames = func() []string {
+		ret := polyfill.MapsKeys(env)
+		polyfill.SlicesSort(ret)
+
+		return ret
+	}
+}
+
+// osEnvNames returns the names of the variables in the process environment.
+func osEnvNames() []string {
+	ret := []string{}
+
+	for _, kv := range os.Environ() {
+		k, _, _ := strings.Cut(kv, "=")
+		ret = append(ret, k)
+	}
+
+	return ret
+}
+
+// Clone returns an independent copy of the [Parser], including deep copies of
+// its documents and the links between them. Merging into either Parser
+// doesn't affect the other, so a Parser with common base layers merged can be
+// cloned to merge each of several files on top. MergeFileLayers on the copy
+// continues from the layers already merged rather than merging them again.
+// Settings, including the [Cache], are shared.
+func (p *Parser) Clone() *Parser {
+	ret := *p
+	m := map[*Document]*Document{}
+
+	ret.docs = cloneDocuments(p.docs, m)
+	ret.files = polyfill.SlicesClone(p.files)
+	ret.resume = true
+
+	if p.layers != nil {
+		ret.layers = p.layers.clone(m)
+	}
+
+	return &ret
+}
+
 // MergeDocument applies the supplied Document to the [Parser]'s current
 // internal document state using bkl's merge semantics. If expand is true,
 // documents without $match will append; otherwise this is an error.
 func (p *Parser) MergeDocument(patch *Document) error {
+	p.layers = nil
+
+	return p.mergeDocument(patch)
+}
+
+func (p *Parser) mergeDocument(patch *Document) error {
+	if p.provenance && patch.provenance == nil {
+		patch.provenance = newProvenance(patch.Data, patch.sourceAt)
+	}
+
+	if p.sourceOrder && patch.keys == nil {
+		patch.keys = newKeyOrder(patch.Data, patch.positions)
+	}
+
 	matched, err := p.mergePatchMatch(patch)
 	if err != nil {
 		return err
@@ -156,28 +296,174 @@ func (p *Parser) mergePatchMatch(patch *Document) (bool, error) {
 		}
 	}
 
-	return true, fmt.Errorf("%#v: %w", m, ErrNoMatchFound)
+	return true, annotateError(withKey(fmt.Errorf("%#v: %w", m, ErrNoMatchFound), "$match"), patch)
 }
 
 // MergeFile parses the file at path and merges its contents into the
 // [Parser]'s document state using bkl's merge semantics.
 func (p *Parser) MergeFile(path string) error {
-	f, err := p.loadFile(path, nil)
+	f, err := p.loadFile(path)
 	if err != nil {
 		return err
 	}
 
+	p.layers = nil
+	p.addFiles(f)
+
 	return p.mergeFile(f)
 }
 
 // MergeFileLayers determines relevant layers from the supplied path and merges
 // them in order.
+//
+// If the [Parser] was made by [Parser.Clone] and its documents are exactly the
+// result of merging the first of those layers by previous MergeFileLayers
+// calls, or it is empty and a [Cache] holds that result, they aren't merged
+// again. Otherwise, as for other merges, the layers are merged on top of the
+// existing documents.
 func (p *Parser) MergeFileLayers(path string) error {
-	files, err := p.loadFileAndParents(path, nil)
+	files, err := p.loadFileAndParents(path)
 	if err != nil {
 		return err
 	}
 
+	p.addFiles(files...)
+
+	keys := p.layerKeys(files)
+
+	start := p.resumeLayers(files, keys)
+	continued := start > 0 || len(p.docs) == 0
+
+	if start == 0 {
+		p.layers = nil
+	}
+
+	for i := start; i < len(files); i++ {
+		err := p.mergeFile(files[i])
+		if err != nil {
+			p.layers = nil
+			return err
+		}
+
+		if !continued || keys[i] == "" {
+			p.layers = nil
+			continue
+		}
+
+		p.layers = &snapshot{key: keys[i], files: append(p.layerFiles(), files[i].docs)}
+
+		if i < len(files)-1 && !p.cache.hasMerge(keys[i]) {
+			p.cache.putMerge(p.snapshot())
+		}
+	}
+
+	return nil
+}
+
+// resumeLayers finds the longest prefix of files already merged, either into
+// the Parser if it was cloned or in the cache if the Parser is empty, and
+// makes the remaining files link to the documents of that prefix. It returns
+// the number of files to skip.
+func (p *Parser) resumeLayers(files []*file, keys []string) int {
+	for i := len(files) - 2; i >= 0; i-- {
+		var snap *snapshot
+
+		switch {
+		case keys[i] == "":
+			continue
+
+		case len(p.docs) == 0:
+			snap = p.cache.getMerge(keys[i])
+
+		case p.resume && p.layers != nil && p.layers.key == keys[i]:
+			snap = p.layers
+		}
+
+		if snap == nil || !relinkLayers(files, snap.files) {
+			continue
+		}
+
+		if len(p.docs) == 0 {
+			p.docs = snap.docs
+		}
+
+		p.layers = &snapshot{key: snap.key, files: snap.files}
+		p.log("[%s] resuming after %d layers", files[len(files)-1], i+1)
+
+		return i + 1
+	}
+
+	return 0
+}
+
+// relinkLayers replaces links from files after the first len(prefix) to
+// documents in those files with links to the corresponding documents in
+// prefix. It returns false if the documents don't correspond.
+func relinkLayers(files []*file, prefix [][]*Document) bool {
+	m := map[*Document]*Document{}
+
+	for i, docs := range prefix {
+		if len(docs) != len(files[i].docs) {
+			return false
+		}
+
+		for j, doc := range docs {
+			m[files[i].docs[j]] = doc
+		}
+	}
+
+	for _, f := range files[len(prefix):] {
+		for _, doc := range f.docs {
+			for i, parent := range doc.Parents {
+				if to, found := m[parent]; found {
+					doc.Parents[i] = to
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+func (p *Parser) layerFiles() [][]*Document {
+	if p.layers == nil {
+		return nil
+	}
+
+	return p.layers.files
+}
+
+// snapshot returns a copy of the Parser's documents and layers.
+func (p *Parser) snapshot() *snapshot {
+	snap := &snapshot{docs: p.docs}
+
+	if p.layers != nil {
+		snap.key = p.layers.key
+		snap.files = p.layers.files
+	}
+
+	return snap.clone(map[*Document]*Document{})
+}
+
+// MergeReader parses documents in the specified format from r and merges
+// them, after any layers specified with $parent, into the [Parser]'s document
+// state. name is used in error messages and as the base for relative $parent
+// paths; it does not need to exist. Parents are not inferred from name.
+func (p *Parser) MergeReader(r io.Reader, format, name string) error {
+	f, err := p.loadReader(r, format, name, true)
+	if err != nil {
+		return err
+	}
+
+	p.layers = nil
+
+	files, err := p.loadParents(f)
+	if err != nil {
+		return err
+	}
+
+	p.addFiles(files...)
+
 	for _, f := range files {
 		err := p.mergeFile(f)
 		if err != nil {
@@ -188,17 +474,39 @@ func (p *Parser) MergeFileLayers(path string) error {
 	return nil
 }
 
+// Files returns the paths of all files read by merges so far, in merge order,
+// including parents, the targets of symlinks and files read by $file and
+// $import. Each path appears once.
+// Documents that weren't read from files (e.g. stdin) are not included.
+func (p *Parser) Files() []string {
+	return polyfill.SlicesClone(p.files)
+}
+
+func (p *Parser) addFiles(files ...*file) {
+	for _, f := range files {
+		if f.virtual {
+			continue
+		}
+
+		for _, path := range append([]string{f.link, f.path}, f.includes...) {
+			if path != "" && !polyfill.SlicesContains(p.files, path) {
+				p.files = append(p.files, path)
+			}
+		}
+	}
+}
+
 // mergeFile applies an already-parsed file object into the [Parser]'s
 // document state.
 func (p *Parser) mergeFile(f *file) error {
 	p.log("[%s] merging", f)
 
-	for _, doc := range f.docs {
+	for i, doc := range f.docs {
 		p.log("[%s] merging", doc)
 
-		err := p.MergeDocument(doc)
+		err := p.mergeDocument(doc)
 		if err != nil {
-			return fmt.Errorf("[%s:%s]: %w", f, doc, err)
+			return withDocument(err, f.path, i)
 		}
 	}
 
@@ -211,28 +519,62 @@ func (p *Parser) Documents() []*Document {
 	return p.docs
 }
 
+// cloneDocs returns copies of all documents, for processing. If ordered is
+// true, the copies have their own key order tables to update; otherwise they
+// have none.
+func (p *Parser) cloneDocs(ordered bool) []*Document {
+	ret := make([]*Document, len(p.docs))
+
+	for i, doc := range p.docs {
+		ret[i] = doc.clone()
+		ret[i].keys = nil
+
+		if ordered && doc.keys != nil {
+			ret[i].keys = doc.keys.clone()
+		}
+	}
+
+	return ret
+}
+
 // outputDocument returns the output objects generated by the specified
-// document.
-func (p *Parser) outputDocument(doc *Document) ([]any, error) {
-	obj, err := Process(doc.Data, doc, p.docs)
+// document. Processing modifies doc and may read or modify any of docs, so
+// they should be copies (see cloneDocs). If ordered is true, maps are
+// returned as orderedMaps in source key order. If commented is true, maps in
+// documents with comments are returned as orderedMaps carrying them.
+func (p *Parser) outputDocument(doc *Document, docs []*Document, ordered, commented bool) ([]any, error) {
+	var rec *recorder
+	if ordered {
+		rec = &recorder{keys: doc.keys}
+	}
+
+	obj, err := process(doc.Data, doc, docs, 0, rec, "")
 	if err != nil {
-		return nil, err
+		return nil, annotateError(err, doc)
 	}
 
 	if obj == nil {
 		return nil, nil
 	}
 
-	obj, outs, err := findOutputs(obj)
+	obj, outs, paths, err := findOutputs(obj, doc.keys, "")
 	if err != nil {
 		return nil, err
 	}
 
-	if len(outs) == 0 {
+	// Paths within $output subtrees don't match document paths
+	root := len(outs) == 0
+
+	if root {
 		outs = append(outs, obj)
+		paths = append(paths, "")
 	}
 
+	i := -1
+
 	outs, err = filterList(outs, func(v any) ([]any, error) {
+		i++
+
 		v2, err := filterOutput(v)
 		if err != nil {
 			return nil, err
@@ -244,9 +586,19 @@ func (p *Parser) outputDocument(doc *Document) ([]any, error) {
 
 		err = validate(v2)
 		if err != nil {
+			if root {
+				return nil, annotateError(err, doc)
+			}
+
 			return nil, err
 		}
 
+		v2 = unliteral(v2)
+
+		if ordered || (commented && len(doc.comments) > 0) {
+			v2 = doc.keys.apply(v2, paths[i], doc.comments)
+		}
+
 		return []any{v2}, nil
 	})
 
@@ -258,13 +610,25 @@ func (p *Parser) outputDocument(doc *Document) ([]any, error) {
 }
 
 // OutputDocuments returns the output objects generated by all documents.
+//
+// The merged document state isn't modified, so OutputDocuments and the other
+// Output methods may be called repeatedly and concurrently.
 func (p *Parser) OutputDocuments() ([]any, error) {
+	return p.outputDocuments(false, false)
+}
+
+func (p *Parser) outputDocuments(ordered, commented bool) ([]any, error) {
 	ret := []any{}
 
-	for _, doc := range p.docs {
-		outs, err := p.outputDocument(doc)
+	// Directives are resolved in a copy of the documents so that chained
+	// references see the results of earlier processing without mutating
+	// p.docs.
+	docs := p.cloneDocs(ordered)
+
+	for i, doc := range docs {
+		outs, err := p.outputDocument(doc, docs, ordered, commented)
 		if err != nil {
-			return nil, err
+			return nil, withDocument(err, "", i)
 		}
 
 		ret = append(ret, outs...)
@@ -275,13 +639,17 @@ func (p *Parser) OutputDocuments() ([]any, error) {
 
 // Output returns all documents encoded in the specified format and merged into
 // a stream.
+//
+// Map keys are sorted unless [Parser.SetSourceOrder] is enabled and format is
+// one of the built-in formats. Comments on keys in YAML layers are written to
+// YAML output, and as "#" comments to TOML output.
 func (p *Parser) Output(format string) ([]byte, error) {
-	outs, err := p.OutputDocuments()
+	f, err := GetFormat(format)
 	if err != nil {
 		return nil, err
 	}
 
-	f, err := GetFormat(format)
+	outs, err := p.outputDocuments(p.sourceOrder && f.ordered, f.commented)
 	if err != nil {
 		return nil, err
 	}
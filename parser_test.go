@@ -7,10 +7,13 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/gopatchy/bkl"
 	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func ExampleNew() {
@@ -110,6 +113,24 @@ func ExampleParser_MergeDocument() {
 	// {"a":1,"b":2}
 }
 
+func ExampleParser_MergeReader() {
+	b := bkl.New()
+
+	// $parent is relative to the virtual name
+	r := strings.NewReader("$parent: a\nport: 8082\n")
+
+	err := b.MergeReader(r, "yaml", "tests/example1/virtual.yaml")
+	if err != nil {
+		panic(err)
+	}
+
+	if err = b.OutputToWriter(os.Stdout, "json"); err != nil {
+		panic(err)
+	}
+	// Output:
+	// {"addr":"127.0.0.1","name":"myService","port":8082}
+}
+
 func ExampleParser_Output() {
 	b := bkl.New()
 
@@ -265,3 +286,52 @@ func writeFile(t *testing.T, filename string, content []byte) (string, error) {
 
 	return path, nil
 }
+
+func TestOutputRepeatable(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	require.NoError(t, b.MergeFileLayers("tests/merge-race/a.b.yaml"))
+
+	expected := "{\"a\":1,\"b\":1,\"c\":{\"a\":1}}\n"
+
+	for i := 0; i < 2; i++ {
+		blob, err := b.Output("json")
+		require.NoError(t, err)
+		require.Equal(t, expected, string(blob))
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			blob, err := b.Output("json")
+			assert.NoError(t, err)
+			assert.Equal(t, expected, string(blob))
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestFiles(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	require.NoError(t, b.MergeFileLayers("tests/files/c.yaml"))
+	require.NoError(t, b.MergeFileLayers("tests/files/d.yaml"))
+	require.Equal(t, []string{
+		"tests/files/a.yaml",
+		"tests/files/a.b.yaml",
+		"tests/files/c.yaml",
+		"tests/files/v/one.yaml",
+		"tests/files/v/two.yaml",
+		"tests/files/d.yaml",
+	}, b.Files())
+}
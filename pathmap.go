@@ -0,0 +1,155 @@
+package bkl
+
+import (
+	"strings"
+)
+
+// A pathMap maps key paths within a document (e.g. "a.b[2].c", or "" for the
+// root) to values. Paths are also indexed by their parent, so that operations
+// on a path and everything below it only visit those entries instead of the
+// whole map.
+type pathMap[V any] struct {
+	vals map[string]V
+
+	// children maps paths to the paths one level below them that have
+	// entries, or have entries below them.
+	children map[string]map[string]bool
+}
+
+func newPathMap[V any]() pathMap[V] {
+	return pathMap[V]{
+		vals:     map[string]V{},
+		children: map[string]map[string]bool{},
+	}
+}
+
+func (pm *pathMap[V]) get(path string) (V, bool) {
+	v, found := pm.vals[path]
+	return v, found
+}
+
+func (pm *pathMap[V]) set(path string, v V) {
+	pm.vals[path] = v
+
+	for path != "" {
+		parent := parentPath(path)
+
+		children := pm.children[parent]
+		if children == nil {
+			children = map[string]bool{}
+			pm.children[parent] = children
+		}
+
+		if children[path] {
+			return
+		}
+
+		children[path] = true
+		path = parent
+	}
+}
+
+// remove forgets path and everything below it.
+func (pm *pathMap[V]) remove(path string) {
+	pm.take(path, nil)
+}
+
+// take removes path and everything below it, calling fn (if non-nil) with
+// each entry removed.
+func (pm *pathMap[V]) take(path string, fn func(string, V)) {
+	pm.takeTree(path, fn)
+
+	if path != "" {
+		delete(pm.children[parentPath(path)], path)
+	}
+}
+
+func (pm *pathMap[V]) takeTree(path string, fn func(string, V)) {
+	if v, found := pm.vals[path]; found {
+		if fn != nil {
+			fn(path, v)
+		}
+
+		delete(pm.vals, path)
+	}
+
+	for child := range pm.children[path] {
+		pm.takeTree(child, fn)
+	}
+
+	delete(pm.children, path)
+}
+
+// move moves the entries at and below from to the same paths below to,
+// replacing what was there.
+func (pm *pathMap[V]) move(from, to string) {
+	if from == to {
+		return
+	}
+
+	moved := map[string]V{}
+
+	pm.take(from, func(path string, v V) {
+		moved[joinPath(to, strings.TrimPrefix(path[len(from):], "."))] = v
+	})
+
+	pm.remove(to)
+
+	for path, v := range moved {
+		pm.set(path, v)
+	}
+}
+
+// filter renumbers the entries of the list at path after entries for which
+// keep is false have been removed.
+func (pm *pathMap[V]) filter(path string, keep []bool) {
+	moved := map[string]V{}
+
+	for child := range pm.children[path] {
+		newPath, found, kept := filterPath(child, path, keep)
+		if !found {
+			continue
+		}
+
+		pm.take(child, func(p string, v V) {
+			if kept {
+				moved[newPath+p[len(child):]] = v
+			}
+		})
+	}
+
+	for p, v := range moved {
+		pm.set(p, v)
+	}
+}
+
+func (pm *pathMap[V]) clone() pathMap[V] {
+	ret := pathMap[V]{
+		vals:     make(map[string]V, len(pm.vals)),
+		children: make(map[string]map[string]bool, len(pm.children)),
+	}
+
+	for path, v := range pm.vals {
+		ret.vals[path] = v
+	}
+
+	for path, children := range pm.children {
+		ret.children[path] = make(map[string]bool, len(children))
+
+		for child := range children {
+			ret.children[path][child] = true
+		}
+	}
+
+	return ret
+}
+
+// parentPath returns the path of the map or list containing path.
+func parentPath(path string) string {
+	i := strings.LastIndexAny(path, ".[")
+	if i == -1 {
+		return ""
+	}
+
+	return path[:i]
+}
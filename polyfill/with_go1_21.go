@@ -26,6 +26,10 @@ func SlicesClone[S ~[]E, E any](s S) S { //nolint:ireturn
 	return slices.Clone(s)
 }
 
+func SlicesContains[S ~[]E, E comparable](s S, v E) bool {
+	return slices.Contains(s, v)
+}
+
 func SlicesDeleteFunc[S ~[]E, E any](s S, del func(E) bool) S { //nolint:ireturn
 	return slices.DeleteFunc(s, del)
 }
@@ -40,6 +40,10 @@ func SlicesClone[S ~[]E, E any](s S) S { //nolint:ireturn
 	return append(S([]E{}), s...)
 }
 
+func SlicesContains[S ~[]E, E comparable](s S, v E) bool {
+	return slices.Contains(s, v)
+}
+
 // Copied from go1.21 slices
 func SlicesDeleteFunc[S ~[]E, E any](s S, del func(E) bool) S { //nolint:ireturn
 	for i, v := range s {
@@ -0,0 +1,222 @@
+package bkl
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gopatchy/bkl/polyfill"
+)
+
+// A Position is a location in a source file.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// positions maps key paths within a document (e.g. "a.b[2].c") to the
+// locations that set them.
+type positions map[string][]Position
+
+func keyPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+func indexPath(path string, i int) string {
+	return fmt.Sprintf("%s[%d]", path, i)
+}
+
+func (ps positions) add(path string, pos Position) {
+	ps[path] = append(ps[path], pos)
+}
+
+// lookup returns the positions recorded for path, most recent layer first.
+func (ps positions) lookup(path string) []Position {
+	poss := ps[path]
+	ret := make([]Position, 0, len(poss))
+
+	for i := len(poss) - 1; i >= 0; i-- {
+		ret = append(ret, poss[i])
+	}
+
+	return ret
+}
+
+func (ps positions) clone() positions {
+	ret := make(positions, len(ps))
+
+	for path, poss := range ps {
+		ret[path] = polyfill.SlicesClone(poss)
+	}
+
+	return ret
+}
+
+func (ps positions) setFile(file string) {
+	for _, poss := range ps {
+		for i := range poss {
+			poss[i].File = file
+		}
+	}
+}
+
+func (ps positions) addLines(n int) {
+	for _, poss := range ps {
+		for i := range poss {
+			poss[i].Line += n
+		}
+	}
+}
+
+// remap translates the paths in ps, which are relative to patchData, to the
+// paths that the same values will have once patchData is merged into dstData.
+// It must be called before merging, since merging modifies both.
+func (ps positions) remap(dstData, patchData any) positions {
+	ret := positions{}
+
+	for path, poss := range ps {
+		path = remapPath(path, dstData, patchData)
+		if path == "" {
+			continue
+		}
+
+		ret[path] = append(ret[path], poss...)
+	}
+
+	return ret
+}
+
+func (ps positions) merge(other positions) {
+	for path, poss := range other {
+		ps[path] = append(ps[path], poss...)
+	}
+}
+
+// remapPath translates a single path for remap. Returns "" if the value
+// doesn't land at a predictable location (e.g. list entries merged via $match).
+func remapPath(path string, dstData, patchData any) string {
+	ret := ""
+	rest := path
+
+	for rest != "" {
+		var seg string
+
+		i := strings.IndexAny(rest[1:], ".[")
+		if i == -1 {
+			seg, rest = rest, ""
+		} else {
+			seg, rest = rest[:i+1], rest[i+1:]
+		}
+
+		if !strings.HasPrefix(seg, "[") {
+			key := strings.TrimPrefix(seg, ".")
+			ret = keyPath(ret, key)
+
+			if m, ok := patchData.(map[string]any); ok && hasMapBoolValue(m, "$replace", true) {
+				dstData = nil
+			}
+
+			dstData = mapValue(dstData, key)
+			patchData = mapValue(patchData, key)
+
+			continue
+		}
+
+		idx, err := strconv.Atoi(strings.Trim(seg, "[]"))
+		if err != nil {
+			return ""
+		}
+
+		patchList, _ := patchData.([]any)
+		if idx >= len(patchList) {
+			return ""
+		}
+
+		dstList, _ := dstData.([]any)
+		_, dstList = popListString(dstList, "$required")
+
+		newIdx := len(dstList)
+
+		for _, v := range patchList[:idx+1] {
+			if !isListAppend(v) {
+				return ""
+			}
+
+			newIdx++
+		}
+
+		ret = indexPath(ret, newIdx-1)
+		dstData = nil
+		patchData = patchList[idx]
+	}
+
+	return ret
+}
+
+// isListAppend returns whether v is appended as-is when merged into a list.
+func isListAppend(v any) bool {
+	switch v2 := v.(type) {
+	case string:
+		return v2 != "$replace" && v2 != "$required"
+
+	case map[string]any:
+		for _, k := range []string{"$delete", "$match", "$replace"} {
+			if _, found := v2[k]; found {
+				return false
+			}
+		}
+
+		return true
+
+	default:
+		return true
+	}
+}
+
+func mapValue(obj any, key string) any {
+	m, ok := obj.(map[string]any)
+	if !ok {
+		return nil
+	}
+
+	return m[key]
+}
+
+// lineIndex converts byte offsets into line and column numbers.
+type lineIndex []int
+
+func newLineIndex(in []byte) lineIndex {
+	li := lineIndex{0}
+
+	for i, c := range in {
+		if c == '\n' {
+			li = append(li, i+1)
+		}
+	}
+
+	return li
+}
+
+func (li lineIndex) position(offset int) Position {
+	line := sort.Search(len(li), func(i int) bool { return li[i] > offset })
+
+	return Position{
+		Line:   line,
+		Column: offset - li[line-1] + 1,
+	}
+}
+
+func countLines(in []byte) int {
+	return bytes.Count(in, []byte{'\n'})
+}
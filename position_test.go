@@ -0,0 +1,65 @@
+package bkl_test
+
+import (
+	"testing"
+
+	"github.com/gopatchy/bkl"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPositionUselessOverride(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	err := b.MergeFileLayers("tests/merge-map-useless/a.b.yaml")
+	require.ErrorIs(t, err, bkl.ErrUselessOverride)
+	require.EqualError(t, err, "tests/merge-map-useless/a.b.yaml:1:1, tests/merge-map-useless/a.yaml:1:1: a: 1: useless override (bkl error)")
+}
+
+func TestPositionRequired(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	require.NoError(t, b.MergeFileLayers("tests/position-required/a.b.toml"))
+
+	_, err := b.Output("json")
+	require.ErrorIs(t, err, bkl.ErrRequiredField)
+	require.EqualError(t, err, "tests/position-required/a.json:3:5: a.b: required field not set (bkl error)")
+}
+
+func TestPositionTOML(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	require.NoError(t, b.MergeFileLayers("tests/position-toml/a.toml"))
+
+	_, err := b.Output("json")
+	require.ErrorIs(t, err, bkl.ErrRequiredField)
+	require.EqualError(t, err, "tests/position-toml/a.toml:7:1: a[1].b: required field not set (bkl error)")
+}
+
+func TestPositionMatch(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	err := b.MergeFileLayers("tests/position-match/a.b.yaml")
+	require.ErrorIs(t, err, bkl.ErrNoMatchFound)
+	require.ErrorContains(t, err, "tests/position-match/a.b.yaml:3:1: $match: ")
+}
+
+func TestPositionYAMLStream(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	require.NoError(t, b.MergeFileLayers("tests/position-yaml-stream/a.yaml"))
+	require.Len(t, b.Documents(), 3)
+
+	_, err := b.Output("json")
+	require.ErrorIs(t, err, bkl.ErrRequiredField)
+	require.EqualError(t, err, "tests/position-yaml-stream/a.yaml:7:3: a.b: required field not set (bkl error)")
+}
@@ -9,12 +9,14 @@ import (
 )
 
 func Process(obj any, mergeFrom *Document, mergeFromDocs []*Document) (any, error) {
-	return process(obj, mergeFrom, mergeFromDocs, 0)
+	return process(obj, mergeFrom, mergeFromDocs, 0, nil, "")
 }
 
 // process() and descendants intentionally mutate obj to handle chained
-// references
-func process(obj any, mergeFrom *Document, mergeFromDocs []*Document, depth int) (any, error) {
+// references; Parser passes copies of its documents so that output is
+// repeatable. If rec is non-nil, the source of values moved or copied during
+// processing is recorded in it; path is the key path of obj.
+func process(obj any, mergeFrom *Document, mergeFromDocs []*Document, depth int, rec *recorder, path string) (any, error) {
 	depth++
 
 	if depth > 1000 {
@@ -23,37 +25,50 @@ func process(obj any, mergeFrom *Document, mergeFromDocs []*Document, depth int)
 
 	switch obj2 := obj.(type) {
 	case map[string]any:
-		return processMap(obj2, mergeFrom, mergeFromDocs, depth)
+		return processMap(obj2, mergeFrom, mergeFromDocs, depth, rec, path)
 
 	case []any:
-		return processList(obj2, mergeFrom, mergeFromDocs, depth)
+		return processList(obj2, mergeFrom, mergeFromDocs, depth, rec, path)
 
 	case string:
-		return processString(obj2, mergeFrom, mergeFromDocs, depth)
+		return processString(obj2, mergeFrom, mergeFromDocs, depth, rec, path)
 
 	default:
 		return obj, nil
 	}
 }
 
-func processMap(obj map[string]any, mergeFrom *Document, mergeFromDocs []*Document, depth int) (any, error) {
+func processMap(obj map[string]any, mergeFrom *Document, mergeFromDocs []*Document, depth int, rec *recorder, path string) (any, error) {
 	// Not copying obj before merge preserves the layering behavior that
 	// tests/merge-race relies upon.
 	if v, found := obj["$merge"]; found {
 		delete(obj, "$merge")
-		return processMapMerge(obj, mergeFrom, mergeFromDocs, v, depth)
+		rec.remove(keyPath(path, "$merge"))
+
+		return processMapMerge(obj, mergeFrom, mergeFromDocs, v, depth, rec, path)
 	}
 
 	if found, v, obj := popMapValue(obj, "$replace"); found {
-		return processMapReplace(obj, mergeFrom, mergeFromDocs, v, depth)
+		return processMapReplace(obj, mergeFrom, mergeFromDocs, v, depth, rec, path)
 	}
 
 	if found, v, obj := popMapValue(obj, "$encode"); found {
-		return processEncode(obj, mergeFrom, mergeFromDocs, v, depth)
+		ret, err := processEncode(obj, mergeFrom, mergeFromDocs, v, depth, rec, path)
+		if err != nil {
+			return nil, withKey(err, "$encode")
+		}
+
+		rec.derive(path, ret)
+
+		return ret, nil
 	}
 
 	if found, v, obj := popMapValue(obj, "$value"); found {
-		return processMapValue(obj, mergeFrom, mergeFromDocs, v, depth)
+		return processMapValue(obj, mergeFrom, mergeFromDocs, v, depth, rec, path)
+	}
+
+	if found, ret, err := processMapDirectives(obj, mergeFrom, mergeFromDocs, depth, rec, path); found {
+		return ret, err
 	}
 
 	keys := polyfill.MapsKeys(obj)
@@ -62,13 +77,15 @@ func processMap(obj map[string]any, mergeFrom *Document, mergeFromDocs []*Docume
 	for _, k := range keys {
 		v := obj[k]
 
-		v2, err := process(v, mergeFrom, mergeFromDocs, depth)
+		v2, err := process(v, mergeFrom, mergeFromDocs, depth, rec, keyPath(path, k))
 		if err != nil {
-			return nil, err
+			return nil, withKey(err, k)
 		}
 
 		if v2 == nil {
 			delete(obj, k)
+			rec.remove(keyPath(path, k))
+
 			continue
 		}
 
@@ -78,156 +95,196 @@ func processMap(obj map[string]any, mergeFrom *Document, mergeFromDocs []*Docume
 	return obj, nil
 }
 
-func processMapMerge(obj map[string]any, mergeFrom *Document, mergeFromDocs []*Document, v any, depth int) (any, error) {
-	in, err := get(mergeFrom, mergeFromDocs, v)
+func processMapMerge(obj map[string]any, mergeFrom *Document, mergeFromDocs []*Document, v any, depth int, rec *recorder, path string) (any, error) {
+	doc, ref, in, err := getRef(mergeFrom, mergeFromDocs, v)
 	if err != nil {
-		return nil, err
+		return nil, withKey(err, "$merge")
 	}
 
-	next, err := mergeMap(obj, in)
+	next, err := mergeMap(obj, in, rec.from(doc, ref, "$merge"), path, "")
 	if err != nil {
 		return nil, err
 	}
 
-	return process(next, mergeFrom, mergeFromDocs, depth)
+	return process(next, mergeFrom, mergeFromDocs, depth, rec, path)
 }
 
-func processMapReplace(obj map[string]any, mergeFrom *Document, mergeFromDocs []*Document, v any, depth int) (any, error) {
-	next, err := get(mergeFrom, mergeFromDocs, v)
+func processMapReplace(obj map[string]any, mergeFrom *Document, mergeFromDocs []*Document, v any, depth int, rec *recorder, path string) (any, error) {
+	doc, ref, next, err := getRef(mergeFrom, mergeFromDocs, v)
 	if err != nil {
-		return nil, err
+		return nil, withKey(err, "$replace")
 	}
 
-	return process(next, mergeFrom, mergeFromDocs, depth)
+	rec.from(doc, ref, "$replace").set(path, "", next)
+
+	return process(next, mergeFrom, mergeFromDocs, depth, rec, path)
 }
 
-func processMapValue(obj map[string]any, mergeFrom *Document, mergeFromDocs []*Document, v any, depth int) (any, error) {
-	return process(v, mergeFrom, mergeFromDocs, depth)
+func processMapValue(obj map[string]any, mergeFrom *Document, mergeFromDocs []*Document, v any, depth int, rec *recorder, path string) (any, error) {
+	rec.move(keyPath(path, "$value"), path)
+
+	return process(v, mergeFrom, mergeFromDocs, depth, rec, path)
 }
 
-func processList(obj []any, mergeFrom *Document, mergeFromDocs []*Document, depth int) (any, error) {
+func processList(obj []any, mergeFrom *Document, mergeFromDocs []*Document, depth int, rec *recorder, path string) (any, error) {
+	rec.filterListMapValue(path, obj, "$merge")
+
 	m, obj, err := popListMapValue(obj, "$merge")
 	if err != nil {
 		return nil, err
 	}
 
 	if m != nil {
-		return processListMerge(obj, mergeFrom, mergeFromDocs, m, depth)
+		return processListMerge(obj, mergeFrom, mergeFromDocs, m, depth, rec, path)
 	}
 
+	rec.filterListMapValue(path, obj, "$replace")
+
 	m, obj, err = popListMapValue(obj, "$replace")
 	if err != nil {
 		return nil, err
 	}
 
 	if m != nil {
-		return processListReplace(obj, mergeFrom, mergeFromDocs, m, depth)
+		return processListReplace(obj, mergeFrom, mergeFromDocs, m, depth, rec, path)
 	}
 
+	rec.filterListMapValue(path, obj, "$encode")
+
 	m, obj, err = popListMapValue(obj, "$encode")
 	if err != nil {
 		return nil, err
 	}
 
 	if m != nil {
-		return processEncode(obj, mergeFrom, mergeFromDocs, m, depth)
+		ret, err := processEncode(obj, mergeFrom, mergeFromDocs, m, depth, rec, path)
+		if err != nil {
+			return nil, withDirective(err, "$encode")
+		}
+
+		rec.derive(path, ret)
+
+		return ret, nil
+	}
+
+	if found, ret, err := processListDirectives(obj, mergeFrom, mergeFromDocs, depth, rec, path); found {
+		return ret, err
 	}
 
+	i := -1
+	keep := make([]bool, len(obj))
+
 	obj, err = filterList(obj, func(v any) ([]any, error) {
-		v2, err := process(v, mergeFrom, mergeFromDocs, depth)
+		i++
+
+		v2, err := process(v, mergeFrom, mergeFromDocs, depth, rec, indexPath(path, i))
 		if err != nil {
-			return nil, err
+			return nil, withIndex(err, i)
 		}
 
 		if v2 == nil {
 			return nil, nil
 		}
 
+		keep[i] = true
+
 		return []any{v2}, nil
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	rec.filter(path, keep)
+
 	return obj, nil
 }
 
-func processListMerge(obj []any, mergeFrom *Document, mergeFromDocs []*Document, m any, depth int) (any, error) {
-	in, err := get(mergeFrom, mergeFromDocs, m)
+func processListMerge(obj []any, mergeFrom *Document, mergeFromDocs []*Document, m any, depth int, rec *recorder, path string) (any, error) {
+	doc, ref, in, err := getRef(mergeFrom, mergeFromDocs, m)
 	if err != nil {
-		return nil, err
+		return nil, withDirective(err, "$merge")
 	}
 
-	next, err := mergeList(obj, in)
+	next, err := mergeList(obj, in, rec.from(doc, ref, "$merge"), path, "")
 	if err != nil {
 		return nil, err
 	}
 
-	return process(next, mergeFrom, mergeFromDocs, depth)
+	return process(next, mergeFrom, mergeFromDocs, depth, rec, path)
 }
 
-func processListReplace(obj []any, mergeFrom *Document, mergeFromDocs []*Document, m any, depth int) (any, error) {
-	next, err := get(mergeFrom, mergeFromDocs, m)
+func processListReplace(obj []any, mergeFrom *Document, mergeFromDocs []*Document, m any, depth int, rec *recorder, path string) (any, error) {
+	doc, ref, next, err := getRef(mergeFrom, mergeFromDocs, m)
 	if err != nil {
-		return nil, err
+		return nil, withDirective(err, "$replace")
 	}
 
-	return process(next, mergeFrom, mergeFromDocs, depth)
+	rec.from(doc, ref, "$replace").set(path, "", next)
+
+	return process(next, mergeFrom, mergeFromDocs, depth, rec, path)
 }
 
-func processString(obj string, mergeFrom *Document, mergeFromDocs []*Document, depth int) (any, error) {
+func processString(obj string, mergeFrom *Document, mergeFromDocs []*Document, depth int, rec *recorder, path string) (any, error) {
 	if strings.HasPrefix(obj, "$merge:") {
-		return processStringMerge(obj, mergeFrom, mergeFromDocs, depth)
+		return processStringMerge(obj, mergeFrom, mergeFromDocs, depth, rec, path)
 	}
 
 	if strings.HasPrefix(obj, "$replace:") {
-		return processStringReplace(obj, mergeFrom, mergeFromDocs, depth)
+		return processStringReplace(obj, mergeFrom, mergeFromDocs, depth, rec, path)
+	}
+
+	if strings.HasPrefix(obj, "$interp:") {
+		return processStringInterp(obj, mergeFrom, mergeFromDocs, depth)
+	}
+
+	if found, ret, err := processStringDirective(obj, mergeFrom, mergeFromDocs, depth, rec, path); found {
+		return ret, err
 	}
 
 	return obj, nil
 }
 
-func processStringMerge(obj string, mergeFrom *Document, mergeFromDocs []*Document, depth int) (any, error) {
-	path := strings.TrimPrefix(obj, "$merge:")
-
-	in, err := get(mergeFrom, mergeFromDocs, path)
+func processStringMerge(obj string, mergeFrom *Document, mergeFromDocs []*Document, depth int, rec *recorder, path string) (any, error) {
+	doc, ref, in, err := getRef(mergeFrom, mergeFromDocs, strings.TrimPrefix(obj, "$merge:"))
 	if err != nil {
-		return nil, err
+		return nil, withDirective(err, "$merge")
 	}
 
-	return process(in, mergeFrom, mergeFromDocs, depth)
-}
+	rec.from(doc, ref, "$merge").set(path, "", in)
 
-func processStringReplace(obj string, mergeFrom *Document, mergeFromDocs []*Document, depth int) (any, error) {
-	path := strings.TrimPrefix(obj, "$replace:")
+	return process(in, mergeFrom, mergeFromDocs, depth, rec, path)
+}
 
-	in, err := get(mergeFrom, mergeFromDocs, path)
+func processStringReplace(obj string, mergeFrom *Document, mergeFromDocs []*Document, depth int, rec *recorder, path string) (any, error) {
+	doc, ref, in, err := getRef(mergeFrom, mergeFromDocs, strings.TrimPrefix(obj, "$replace:"))
 	if err != nil {
-		return nil, err
+		return nil, withDirective(err, "$replace")
 	}
 
-	return process(in, mergeFrom, mergeFromDocs, depth)
+	rec.from(doc, ref, "$replace").set(path, "", in)
+
+	return process(in, mergeFrom, mergeFromDocs, depth, rec, path)
 }
 
-func processEncode(obj any, mergeFrom *Document, mergeFromDocs []*Document, v any, depth int) (any, error) {
-	obj2, err := process(obj, mergeFrom, mergeFromDocs, depth)
+func processEncode(obj any, mergeFrom *Document, mergeFromDocs []*Document, v any, depth int, rec *recorder, path string) (any, error) {
+	obj2, err := process(obj, mergeFrom, mergeFromDocs, depth, rec, path)
 	if err != nil {
 		return nil, err
 	}
 
-	return processEncodeAny(obj2, mergeFrom, mergeFromDocs, v, depth)
+	return processEncodeAny(obj2, mergeFrom, mergeFromDocs, v, depth, rec, path)
 }
 
-func processEncodeAny(obj any, mergeFrom *Document, mergeFromDocs []*Document, v any, depth int) (any, error) {
+func processEncodeAny(obj any, mergeFrom *Document, mergeFromDocs []*Document, v any, depth int, rec *recorder, path string) (any, error) {
 	switch v2 := v.(type) {
 	case string:
-		return processEncodeString(obj, mergeFrom, mergeFromDocs, v2, depth)
+		return processEncodeString(obj, mergeFrom, mergeFromDocs, v2, depth, rec, path)
 
 	case []any:
 		for _, v3 := range v2 {
 			var err error
 
-			obj, err = processEncodeAny(obj, mergeFrom, mergeFromDocs, v3, depth)
+			obj, err = processEncodeAny(obj, mergeFrom, mergeFromDocs, v3, depth, rec, path)
 			if err != nil {
 				return nil, err
 			}
@@ -240,7 +297,16 @@ func processEncodeAny(obj any, mergeFrom *Document, mergeFromDocs []*Document, v
 	}
 }
 
-func processEncodeString(obj any, mergeFrom *Document, mergeFromDocs []*Document, v string, depth int) (any, error) {
+func processEncodeString(obj any, mergeFrom *Document, mergeFromDocs []*Document, v string, depth int, rec *recorder, path string) (any, error) {
+	ret, err := processEncodeStringDirective(obj, mergeFrom, mergeFromDocs, v, depth, rec, path)
+	if err != nil {
+		return nil, withDirective(err, fmt.Sprintf("$encode:%s", v))
+	}
+
+	return ret, nil
+}
+
+func processEncodeStringDirective(obj any, mergeFrom *Document, mergeFromDocs []*Document, v string, depth int, rec *recorder, path string) (any, error) {
 	parts := strings.Split(v, ":")
 	cmd := parts[0]
 
@@ -254,7 +320,7 @@ func processEncodeString(obj any, mergeFrom *Document, mergeFromDocs []*Document
 		return base64.StdEncoding.EncodeToString([]byte(obj2)), nil
 
 	case "flags":
-		return processEncodeAny(obj, mergeFrom, mergeFromDocs, []any{"tolist:=", "prefix:--"}, depth+1)
+		return processEncodeAny(obj, mergeFrom, mergeFromDocs, []any{"tolist:=", "prefix:--"}, depth+1, rec, path)
 
 	case "flatten":
 		if len(parts) != 1 {
@@ -330,6 +396,10 @@ func processEncodeString(obj any, mergeFrom *Document, mergeFromDocs []*Document
 		return processToListMap(obj, delim)
 
 	default:
+		if e, found := getEncoder(cmd); found {
+			return e(obj, parts[1:], mergeFrom, mergeFromDocs)
+		}
+
 		if len(parts) != 1 {
 			return nil, fmt.Errorf("$encode: %s: %w", v, ErrInvalidArguments)
 		}
@@ -339,6 +409,10 @@ func processEncodeString(obj any, mergeFrom *Document, mergeFromDocs []*Document
 			return nil, err
 		}
 
+		if f.ordered && rec != nil && rec.keys != nil {
+			obj = rec.keys.apply(obj, path, nil)
+		}
+
 		enc, err := f.MarshalStream([]any{obj})
 		if err != nil {
 			return nil, err
@@ -32,3 +32,33 @@ func TestReplace(t *testing.T) {
 	require.Equal(t, `{"foo":{"bar":{"a":1}},"zig":{"a":1}}
 `, string(blob))
 }
+
+func TestInterpolate(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+	b.SetEnvMap(map[string]string{"NAME": "api", "CMD": "$$(x)"})
+
+	require.NoError(t, b.MergeFileLayers("tests/interp/a.yaml"))
+
+	blob, err := b.Output("json")
+	require.NoError(t, err)
+	require.Equal(t, `{"addr":"example.com","cmd":"$$(x)","copy":"$(x) example.com","lit":"$(x) example.com","m":{"s":"$$(y)"},"name":"api-example.com","plain":"sh -c \"echo $(date)\"","port":8080,"runs":"$8080 $$(x)","sub":{"s":"$$(y)"},"url":"https://example.com:8080/v1"}
+{"other":"https://example.com:8080/v1"}
+`, string(blob))
+
+	for path, sentinel := range map[string]error{
+		"tests/interp-circular/a.yaml": bkl.ErrCircularRef,
+		"tests/interp-missing/a.yaml":  bkl.ErrRefNotFound,
+	} {
+		b := bkl.New()
+		require.NoError(t, b.MergeFileLayers(path))
+
+		_, err := b.Output("json")
+		require.ErrorIs(t, err, sentinel, path)
+	}
+
+	b = bkl.New()
+	b.SetEnvMap(map[string]string{})
+	require.ErrorIs(t, b.MergeFileLayers("tests/interp/a.yaml"), bkl.ErrMissingEnv)
+}
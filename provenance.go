@@ -0,0 +1,470 @@
+package bkl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gopatchy/bkl/polyfill"
+)
+
+// Provenance returns the source of the value at path (e.g. "a.b[2].c") in
+// document docIndex of [Parser.Documents] after processing. Values copied by
+// $merge or $replace report the layer that set them at the referenced path.
+// Provenance is only recorded if enabled with [Parser.SetProvenance] before
+// merging.
+func (p *Parser) Provenance(docIndex int, path string) (Source, error) {
+	_, prov, err := p.processProvenance(docIndex)
+	if err != nil {
+		return Source{}, err
+	}
+
+	src, found := prov.get(path)
+	if !found {
+		return Source{}, fmt.Errorf("%s: %w", path, ErrRefNotFound)
+	}
+
+	return src, nil
+}
+
+// Blame writes every leaf value of every processed document to fh, annotated
+// with its source. As for [Parser.Provenance], [Parser.SetProvenance] must be
+// enabled before merging.
+func (p *Parser) Blame(fh io.Writer) error {
+	tw := tabwriter.NewWriter(fh, 0, 4, 2, ' ', 0)
+
+	for i := range p.docs {
+		obj, prov, err := p.processProvenance(i)
+		if err != nil {
+			return withDocument(err, "", i)
+		}
+
+		if i > 0 {
+			fmt.Fprintln(tw, "---")
+		}
+
+		err = blameLeaves(tw, obj, "", prov)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Flush()
+}
+
+// processProvenance processes a copy of document docIndex, returning the
+// result and the source of every path within it.
+func (p *Parser) processProvenance(docIndex int) (any, *provenance, error) {
+	if docIndex < 0 || docIndex >= len(p.docs) {
+		return nil, nil, fmt.Errorf("document %d: %w", docIndex, ErrInvalidIndex)
+	}
+
+	if !p.provenance {
+		return nil, nil, fmt.Errorf("provenance not recorded (see SetProvenance): %w", ErrInvalidArguments)
+	}
+
+	docs := p.cloneDocs(false)
+	doc := docs[docIndex]
+
+	rec := &recorder{
+		prov:   doc.provenance.clone(),
+		source: doc.provenance.at,
+	}
+
+	obj, err := process(doc.Data, doc, docs, 0, rec, "")
+	if err != nil {
+		return nil, nil, annotateError(err, doc)
+	}
+
+	return unliteral(obj), rec.prov, nil
+}
+
+func blameLeaves(fh io.Writer, obj any, path string, prov *provenance) error {
+	switch obj2 := obj.(type) {
+	case map[string]any:
+		if len(obj2) > 0 {
+			keys := polyfill.MapsKeys(obj2)
+			polyfill.SlicesSort(keys)
+
+			for _, k := range keys {
+				if k == "$output" {
+					continue
+				}
+
+				err := blameLeaves(fh, obj2[k], keyPath(path, k), prov)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+
+	case []any:
+		if len(obj2) > 0 {
+			for i, v := range obj2 {
+				err := blameLeaves(fh, v, indexPath(path, i), prov)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+	}
+
+	val, err := json.Marshal(obj)
+	if err != nil {
+		return polyfill.ErrorsJoin(ErrMarshal, err)
+	}
+
+	_, err = fmt.Fprintf(fh, "%s = %s\t# %s\n", path, val, prov.at(path))
+
+	return err
+}
+
+// A Source identifies the layer that last set a value.
+type Source struct {
+	// Position is the location of the value in the layer that set it. Line
+	// and Column are 0 if unknown.
+	Position
+
+	// Doc is the index of the document within File.
+	Doc int
+
+	// Directive is "$merge" or "$replace" if the value was copied from
+	// another path during output processing, From is that path.
+	Directive string
+	From      string
+}
+
+func (s Source) String() string {
+	ret := s.File
+
+	switch {
+	case s.Line > 0:
+		ret = s.Position.String()
+	case s.File == "":
+		ret = "-"
+	case s.Doc > 0:
+		ret = fmt.Sprintf("%s:doc%d", s.File, s.Doc)
+	}
+
+	if s.Directive != "" {
+		ret += fmt.Sprintf(" (%s:%s)", s.Directive, s.From)
+	}
+
+	return ret
+}
+
+// provenance maps key paths within a document to the source of their current
+// value. Every map, list and leaf value has an entry.
+type provenance struct {
+	pathMap[Source]
+}
+
+func newProvenance(obj any, source func(string) Source) *provenance {
+	ret := &provenance{newPathMap[Source]()}
+	rec := &recorder{prov: ret, source: source}
+	rec.set("", "", obj)
+
+	return ret
+}
+
+// at returns the source recorded for path, or the zero Source if there is
+// none (or prov is nil).
+func (prov *provenance) at(path string) Source {
+	if prov == nil {
+		return Source{}
+	}
+
+	src, _ := prov.get(path)
+
+	return src
+}
+
+func (prov *provenance) clone() *provenance {
+	return &provenance{prov.pathMap.clone()}
+}
+
+// recorder updates a provenance table and a key order table as values are
+// merged into a document. source returns the Source for a path within the
+// value being merged, and order the key order of the map at that path. Either
+// table may be nil to skip tracking it. A nil *recorder records nothing.
+type recorder struct {
+	prov   *provenance
+	source func(srcPath string) Source
+
+	keys  *keyOrder
+	order func(srcPath string) []string
+}
+
+// from returns a recorder that updates the same tables with values copied
+// from path in doc by directive.
+func (r *recorder) from(doc *Document, path []string, directive string) *recorder {
+	if r == nil {
+		return nil
+	}
+
+	from := strings.Join(path, ".")
+
+	return &recorder{
+		prov: r.prov,
+		source: func(srcPath string) Source {
+			fromPath := joinPath(from, srcPath)
+
+			var src Source
+			if doc != nil {
+				src = doc.provenance.at(fromPath)
+			}
+
+			src.Directive = directive
+			src.From = fromPath
+
+			return src
+		},
+		keys: r.keys,
+		order: func(srcPath string) []string {
+			if doc == nil {
+				return nil
+			}
+
+			return doc.keys.at(joinPath(from, srcPath))
+		},
+	}
+}
+
+// set records that v, found at srcPath, replaced the value at dstPath.
+func (r *recorder) set(dstPath, srcPath string, v any) {
+	if r == nil {
+		return
+	}
+
+	if r.prov != nil {
+		r.prov.remove(dstPath)
+
+		walkPaths(v, "", func(rel string) {
+			r.prov.set(joinPath(dstPath, rel), r.source(joinPath(srcPath, rel)))
+		})
+	}
+
+	if r.keys != nil && r.order != nil {
+		walkMaps(v, "", func(rel string) {
+			r.keys.set(joinPath(dstPath, rel), polyfill.SlicesClone(r.order(joinPath(srcPath, rel))))
+		})
+	}
+}
+
+// touch records that the container at dstPath was modified by the value at
+// srcPath, which adds any new keys after the existing ones.
+func (r *recorder) touch(dstPath, srcPath string) {
+	if r == nil {
+		return
+	}
+
+	if r.prov != nil {
+		r.prov.set(dstPath, r.source(srcPath))
+	}
+
+	if r.keys != nil && r.order != nil {
+		r.keys.add(dstPath, r.order(srcPath))
+	}
+}
+
+// fill records v at dstPath, attributing any paths without an entry to the
+// source already recorded for dstPath.
+func (r *recorder) fill(dstPath string, v any) {
+	if r == nil || r.prov == nil {
+		return
+	}
+
+	src := r.prov.at(dstPath)
+
+	walkPaths(v, "", func(rel string) {
+		path := joinPath(dstPath, rel)
+		if _, found := r.prov.get(path); !found {
+			r.prov.set(path, src)
+		}
+	})
+}
+
+// derive records v, computed from the value at dstPath (e.g. by $encode), as
+// having the same source as that value.
+func (r *recorder) derive(dstPath string, v any) {
+	if r == nil || r.prov == nil {
+		return
+	}
+
+	src := r.prov.at(dstPath)
+
+	r.prov.remove(dstPath)
+
+	walkPaths(v, "", func(rel string) {
+		r.prov.set(joinPath(dstPath, rel), src)
+	})
+}
+
+// remove forgets dstPath and everything below it.
+func (r *recorder) remove(dstPath string) {
+	if r == nil {
+		return
+	}
+
+	if r.prov != nil {
+		r.prov.remove(dstPath)
+	}
+
+	if r.keys != nil {
+		r.keys.remove(dstPath)
+	}
+}
+
+// move moves the entries for everything below from to the same paths below
+// to, replacing what was there.
+func (r *recorder) move(from, to string) {
+	if r == nil || from == to {
+		return
+	}
+
+	if r.prov != nil {
+		r.prov.move(from, to)
+	}
+
+	if r.keys != nil {
+		r.keys.move(from, to)
+	}
+}
+
+// filter renumbers the entries of the list at dstPath after entries for
+// which keep is false have been removed.
+func (r *recorder) filter(dstPath string, keep []bool) {
+	if r == nil {
+		return
+	}
+
+	if r.prov != nil {
+		r.prov.filter(dstPath, keep)
+	}
+
+	if r.keys != nil {
+		r.keys.filter(dstPath, keep)
+	}
+}
+
+// filterPath returns the path that path, within an entry of the list at
+// listPath, has after entries of the list for which keep is false have been
+// removed. found is false if path isn't within an entry of the list, and kept
+// is false if the entry was removed.
+func filterPath(path, listPath string, keep []bool) (string, bool, bool) {
+	prefix := listPath + "["
+
+	if !strings.HasPrefix(path, prefix) {
+		return "", false, false
+	}
+
+	end := strings.Index(path[len(prefix):], "]")
+	if end == -1 {
+		return "", false, false
+	}
+
+	idx, err := strconv.Atoi(path[len(prefix) : len(prefix)+end])
+	if err != nil || idx >= len(keep) {
+		return "", false, false
+	}
+
+	if !keep[idx] {
+		return "", true, false
+	}
+
+	newIdx := 0
+
+	for _, k := range keep[:idx] {
+		if k {
+			newIdx++
+		}
+	}
+
+	return indexPath(listPath, newIdx) + path[len(prefix)+end+1:], true, true
+}
+
+// filterListMapValue renumbers the entries of the list l at dstPath for
+// popListMapValue(l, k).
+func (r *recorder) filterListMapValue(dstPath string, l []any, k string) {
+	if r == nil {
+		return
+	}
+
+	r.filter(dstPath, keepList(l, func(v any) bool {
+		vMap, ok := v.(map[string]any)
+		if !ok || len(vMap) != 1 {
+			return true
+		}
+
+		_, found := vMap[k]
+
+		return !found
+	}))
+}
+
+// walkMaps calls fn with the path of every map within obj, including obj
+// itself, relative to path.
+func walkMaps(obj any, path string, fn func(string)) {
+	switch obj2 := obj.(type) {
+	case map[string]any:
+		fn(path)
+
+		for k, v := range obj2 {
+			walkMaps(v, keyPath(path, k), fn)
+		}
+
+	case []any:
+		for i, v := range obj2 {
+			walkMaps(v, indexPath(path, i), fn)
+		}
+	}
+}
+
+// walkPaths calls fn with the path of obj and every value within it, relative
+// to path.
+func walkPaths(obj any, path string, fn func(string)) {
+	fn(path)
+
+	switch obj2 := obj.(type) {
+	case map[string]any:
+		for k, v := range obj2 {
+			walkPaths(v, keyPath(path, k), fn)
+		}
+
+	case []any:
+		for i, v := range obj2 {
+			walkPaths(v, indexPath(path, i), fn)
+		}
+	}
+}
+
+// keepList returns a mask of the entries of l for which keep returns true.
+func keepList(l []any, keep func(any) bool) []bool {
+	ret := make([]bool, len(l))
+
+	for i, v := range l {
+		ret[i] = keep(v)
+	}
+
+	return ret
+}
+
+// keptIndexes returns the indexes of the entries set in mask.
+func keptIndexes(mask []bool) []int {
+	ret := []int{}
+
+	for i, k := range mask {
+		if k {
+			ret = append(ret, i)
+		}
+	}
+
+	return ret
+}
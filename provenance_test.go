@@ -0,0 +1,43 @@
+package bkl_test
+
+import (
+	"testing"
+
+	"github.com/gopatchy/bkl"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProvenance(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+	b.SetProvenance(true)
+
+	require.NoError(t, b.MergeFileLayers("tests/blame-list/a.b.yaml"))
+
+	for path, expected := range map[string]bkl.Source{
+		"x[0]": {Position: bkl.Position{File: "tests/blame-list/a.yaml", Line: 3, Column: 5}},
+		"x[1]": {Position: bkl.Position{File: "tests/blame-list/a.b.yaml", Line: 5, Column: 5}},
+		"x[2]": {Position: bkl.Position{File: "tests/blame-list/a.b.yaml", Line: 3, Column: 5}},
+		"y.z":  {Position: bkl.Position{File: "tests/blame-list/a.yaml", Line: 6, Column: 3}},
+		"w": {
+			Position:  bkl.Position{File: "tests/blame-list/a.yaml", Line: 6, Column: 3},
+			Directive: "$merge",
+			From:      "y.z",
+		},
+	} {
+		src, err := b.Provenance(0, path)
+		require.NoError(t, err, path)
+		require.Equal(t, expected, src, path)
+	}
+
+	_, err := b.Provenance(0, "x[3]")
+	require.ErrorIs(t, err, bkl.ErrRefNotFound)
+
+	// Not recorded unless enabled before merging
+	b = bkl.New()
+	require.NoError(t, b.MergeFileLayers("tests/blame-list/a.b.yaml"))
+
+	_, err = b.Provenance(0, "x[0]")
+	require.ErrorIs(t, err, bkl.ErrInvalidArguments)
+}
@@ -0,0 +1,3 @@
+#!/bin/sh
+echo $(date) $$(x)
+echo $interp:$(x) $merge:y
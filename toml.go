@@ -2,9 +2,12 @@ package bkl
 
 import (
 	"bytes"
-	"regexp"
+	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
 )
 
 func tomlMarshalStream(vs []any) ([]byte, error) {
@@ -20,7 +23,21 @@ func tomlMarshalStream(vs []any) ([]byte, error) {
 			buf.Write([]byte("---\n"))
 		}
 
-		err := enc.Encode(v)
+		if om, ok := v.(*orderedMap); ok {
+			if text := om.comment.text(); text != "" {
+				tomlWriteComment(buf, text)
+				buf.WriteString("\n")
+			}
+
+			err := tomlWriteTable(buf, nil, om, "", false)
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		err := enc.Encode(tomlPlain(v))
 		if err != nil {
 			return nil, err
 		}
@@ -29,22 +46,341 @@ func tomlMarshalStream(vs []any) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-var tomlRE = regexp.MustCompile(`(?m)^(\+\+\+|---)$`)
+// tomlWriteTable writes obj to buf as the TOML table at path, keeping the
+// key order and comments of orderedMaps. It follows the layout of the TOML
+// encoder, which also encodes the keys and values: key/values first, then
+// tables and arrays of tables, each separated by a blank line.
+func tomlWriteTable(buf *bytes.Buffer, path []string, obj any, comment string, header bool) error {
+	if header {
+		tomlWriteComment(buf, comment)
+		fmt.Fprintf(buf, "[%s]\n", strings.Join(path, "."))
+	}
+
+	keys, vals, comments := tomlEntries(obj)
+	hasKV := false
+
+	for _, k := range keys {
+		v := vals[k]
+
+		if v == nil || tomlIsTable(v) || tomlIsArrayTable(v) {
+			continue
+		}
+
+		out, err := toml.Marshal(map[string]any{k: tomlPlain(v)})
+		if err != nil {
+			return err
+		}
+
+		tomlWriteComment(buf, comments[k])
+		buf.Write(out)
+
+		hasKV = true
+	}
+
+	first := true
+
+	for _, k := range keys {
+		v := vals[k]
+
+		if !tomlIsTable(v) && !tomlIsArrayTable(v) {
+			continue
+		}
+
+		if !first || hasKV {
+			buf.WriteString("\n")
+		}
+
+		first = false
+
+		key, err := tomlKey(k)
+		if err != nil {
+			return err
+		}
+
+		path2 := append(append([]string{}, path...), key)
+
+		if tomlIsTable(v) {
+			err = tomlWriteTable(buf, path2, v, comments[k], true)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		tomlWriteComment(buf, comments[k])
+
+		for i, item := range v.([]any) {
+			if i > 0 {
+				buf.WriteString("\n")
+			}
+
+			fmt.Fprintf(buf, "[[%s]]\n", strings.Join(path2, "."))
+
+			err = tomlWriteTable(buf, path2, item, "", false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// tomlEntries returns the keys of the table obj in output order (source
+// order for orderedMaps, sorted otherwise), their values and comments.
+func tomlEntries(obj any) ([]string, map[string]any, map[string]string) {
+	comments := map[string]string{}
+
+	switch obj2 := obj.(type) {
+	case *orderedMap:
+		for k, c := range obj2.comments {
+			comments[k] = c.text()
+		}
+
+		return obj2.keys, obj2.vals, comments
+
+	case map[string]any:
+		keys := make([]string, 0, len(obj2))
+
+		for k := range obj2 {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		return keys, obj2, comments
+
+	default:
+		return nil, nil, comments
+	}
+}
+
+func tomlIsTable(v any) bool {
+	switch v.(type) {
+	case *orderedMap, map[string]any:
+		return true
+	default:
+		return false
+	}
+}
+
+// tomlIsArrayTable returns whether v is written as an array of tables, which
+// the TOML encoder does for non-empty lists of tables.
+func tomlIsArrayTable(v any) bool {
+	list, ok := v.([]any)
+	if !ok || len(list) == 0 {
+		return false
+	}
+
+	for _, item := range list {
+		if !tomlIsTable(item) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// tomlKey returns k as the TOML encoder writes it: bare if possible,
+// otherwise quoted.
+func tomlKey(k string) (string, error) {
+	out, err := toml.Marshal(map[string]any{k: 0})
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(string(out), " = 0\n"), nil
+}
+
+func tomlWriteComment(buf *bytes.Buffer, text string) {
+	if text == "" {
+		return
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Fprintf(buf, "# %s\n", line)
+	}
+}
+
+// tomlSeparators returns the start and end offsets of each "---" or "+++"
+// line in in that separates documents. Such lines within multi-line strings
+// aren't separators.
+func tomlSeparators(in []byte) [][]int {
+	ret := [][]int{}
+	quote := ""
+
+	for i := 0; i < len(in); {
+		if quote == "" && (i == 0 || in[i-1] == '\n') {
+			end := bytes.IndexByte(in[i:], '\n')
+			if end == -1 {
+				end = len(in) - i
+			}
+
+			if line := string(in[i : i+end]); line == "---" || line == "+++" {
+				ret = append(ret, []int{i, i + end})
+				i += end
+
+				continue
+			}
+		}
+
+		rest := in[i:]
+
+		switch {
+		case quote == "" && rest[0] == '#':
+			end := bytes.IndexByte(rest, '\n')
+			if end == -1 {
+				return ret
+			}
+
+			i += end
+
+		case quote == "" && (bytes.HasPrefix(rest, []byte(`"""`)) || bytes.HasPrefix(rest, []byte(`'''`))):
+			quote = string(rest[:3])
+			i += 3
+
+		case quote == "" && (rest[0] == '"' || rest[0] == '\''):
+			quote = string(rest[:1])
+			i++
+
+		case quote == "":
+			i++
+
+		case rest[0] == '\\' && quote[0] == '"':
+			i += 2
+
+		case bytes.HasPrefix(rest, []byte(quote)):
+			i += len(quote)
+			quote = ""
+
+		case rest[0] == '\n' && len(quote) == 1:
+			// Unterminated single-line string; leave the error to the parser
+			quote = ""
+			i++
+
+		default:
+			i++
+		}
+	}
+
+	return ret
+}
 
 func tomlUnmarshalStream(in []byte) ([]any, error) {
-	parts := tomlRE.Split(string(in), -1)
+	docs, _, err := tomlUnmarshalStreamPositions(in)
+	return docs, err
+}
+
+func tomlUnmarshalStreamPositions(in []byte) ([]any, []positions, error) {
 	ret := []any{}
+	poss := []positions{}
+	start := 0
+
+	for _, sep := range append(tomlSeparators(in), []int{len(in), len(in)}) {
+		part := in[start:sep[0]]
 
-	for _, s := range parts {
 		var obj any
 
-		err := toml.Unmarshal([]byte(s), &obj)
+		err := toml.Unmarshal(part, &obj)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+
+		ps, err := tomlPositions(part)
+		if err != nil {
+			return nil, nil, err
 		}
 
+		ps.addLines(countLines(in[:start]))
+
 		ret = append(ret, obj)
+		poss = append(poss, ps)
+		start = sep[1]
+	}
+
+	return ret, poss, nil
+}
+
+func tomlPositions(in []byte) (positions, error) {
+	p := &unstable.Parser{}
+	p.Reset(in)
+
+	ps := positions{}
+	table := ""
+	arrays := map[string]int{}
+
+	for p.NextExpression() {
+		expr := p.Expression()
+
+		switch expr.Kind { //nolint:exhaustive
+		case unstable.Table, unstable.ArrayTable:
+			table = ""
+
+			var last *unstable.Node
+
+			it := expr.Key()
+			for it.Next() {
+				last = it.Node()
+
+				if n, found := arrays[table]; found && table != "" {
+					// Keys within an array table refer to its last entry
+					table = indexPath(table, n-1)
+				}
+
+				table = keyPath(table, string(last.Data))
+				tomlAddPosition(p, last, table, ps)
+			}
+
+			if expr.Kind == unstable.ArrayTable {
+				n := arrays[table]
+				arrays[table] = n + 1
+				table = indexPath(table, n)
+				tomlAddPosition(p, last, table, ps)
+			}
+
+		case unstable.KeyValue:
+			tomlKeyValuePositions(p, expr, table, ps)
+		}
+	}
+
+	return ps, p.Error()
+}
+
+func tomlKeyValuePositions(p *unstable.Parser, node *unstable.Node, path string, ps positions) {
+	it := node.Key()
+	for it.Next() {
+		path = keyPath(path, string(it.Node().Data))
+		tomlAddPosition(p, it.Node(), path, ps)
+	}
+
+	tomlValuePositions(p, node.Value(), path, ps)
+}
+
+func tomlValuePositions(p *unstable.Parser, node *unstable.Node, path string, ps positions) {
+	switch node.Kind { //nolint:exhaustive
+	case unstable.InlineTable:
+		it := node.Children()
+		for it.Next() {
+			tomlKeyValuePositions(p, it.Node(), path, ps)
+		}
+
+	case unstable.Array:
+		it := node.Children()
+		for i := 0; it.Next(); i++ {
+			subPath := indexPath(path, i)
+			tomlAddPosition(p, it.Node(), subPath, ps)
+			tomlValuePositions(p, it.Node(), subPath, ps)
+		}
+	}
+}
+
+func tomlAddPosition(p *unstable.Parser, node *unstable.Node, path string, ps positions) {
+	if node.Raw.Length == 0 {
+		// Some nodes (e.g. arrays) don't record their location
+		return
 	}
 
-	return ret, nil
+	start := p.Shape(node.Raw).Start
+	ps.add(path, Position{Line: start.Line, Column: start.Column})
 }
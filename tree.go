@@ -0,0 +1,443 @@
+package bkl
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/gopatchy/bkl/polyfill"
+)
+
+// Leaves returns the paths of the files in dir and its subdirectories that no
+// other file there uses as a parent, by filename or $parent, or reads with
+// $import or $file, in lexical order. These are the layers to render; the
+// others are bases. Files and directories whose names start with "." are
+// skipped.
+func (p *Parser) Leaves(dir string) ([]string, error) {
+	g, err := p.layerGraph(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = g.err()
+	if err != nil {
+		return nil, err
+	}
+
+	return g.leaves(), nil
+}
+
+// ScanLeaves is like [Parser.Leaves], but continues past files that can't be
+// loaded or whose parents can't be found. It returns the leaves that don't
+// inherit from or read any such file, and an error for each such file, in
+// the order scanned. The returned error is only for failures to list dir.
+func (p *Parser) ScanLeaves(dir string) ([]string, []error, error) {
+	g, err := p.layerGraph(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ret := []string{}
+	memo := map[string]bool{}
+
+	for _, path := range g.leaves() {
+		if !g.broken(path, memo) {
+			ret = append(ret, path)
+		}
+	}
+
+	return ret, polyfill.SlicesClone(g.errs), nil
+}
+
+// Affected returns the leaves in dir (see [Parser.Leaves]) that are, inherit
+// from, or read with $file or $import any of the files in changed, in lexical
+// order. Symlinks are affected by changes to their targets.
+func (p *Parser) Affected(dir string, changed ...string) ([]string, error) {
+	g, err := p.layerGraph(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = g.err()
+	if err != nil {
+		return nil, err
+	}
+
+	isChanged := map[string]bool{}
+
+	for _, path := range changed {
+		isChanged[p.comparablePath(path)] = true
+	}
+
+	memo := map[string]bool{}
+
+	var affected func(string) bool
+
+	affected = func(path string) bool {
+		if ret, found := memo[path]; found {
+			return ret
+		}
+
+		// Parents can't form loops (see fileMRO), but guard anyway
+		memo[path] = false
+
+		ret := isChanged[p.comparablePath(path)]
+
+		if target, found := g.targets[path]; found && affected(target) {
+			ret = true
+		}
+
+		for _, ref := range g.edges(path) {
+			if affected(ref.path) {
+				ret = true
+			}
+		}
+
+		memo[path] = ret
+
+		return ret
+	}
+
+	ret := []string{}
+
+	for _, path := range g.leaves() {
+		if affected(path) {
+			ret = append(ret, path)
+		}
+	}
+
+	return ret, nil
+}
+
+// A layerGraph describes how the files in a directory tree inherit from each
+// other.
+type layerGraph struct {
+	// paths are the files in the tree, in lexical order.
+	paths []string
+
+	// parents are the parents of each file, as determined when loading it,
+	// including files outside the tree that are reachable as parents.
+	parents map[string][]parentRef
+
+	// targets are the targets of files that are symlinks.
+	targets map[string]string
+
+	// deps are the other files that each file reads, with $file or $import.
+	deps map[string][]parentRef
+
+	// errs are the errors from files that couldn't be scanned, in scan
+	// order, and failed the paths of those files. Their parents are
+	// determined by filename only.
+	errs   []error
+	failed map[string]bool
+}
+
+// layerGraph scans the files in dir and its subdirectories and their parents.
+func (p *Parser) layerGraph(dir string) (*layerGraph, error) {
+	paths, err := p.findFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.scanLayers(paths), nil
+}
+
+// scanLayers scans the files in paths and their parents. Files that can't be
+// scanned are recorded in the graph's errs.
+func (p *Parser) scanLayers(paths []string) *layerGraph {
+	g := &layerGraph{
+		paths:   paths,
+		parents: map[string][]parentRef{},
+		targets: map[string]string{},
+		deps:    map[string][]parentRef{},
+		failed:  map[string]bool{},
+	}
+
+	queue := polyfill.SlicesClone(paths)
+
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+
+		if _, found := g.parents[path]; found {
+			continue
+		}
+
+		refs, deps, err := p.scanLayer(g, path)
+		if err != nil {
+			g.errs = append(g.errs, err)
+			g.failed[path] = true
+
+			// Keep the failure from making the file's bases into leaves
+			refs, _ = (&file{path: path, fsys: p.fsys}).parentsFromFilename()
+			deps = nil
+		}
+
+		for i := range refs {
+			refs[i].path = filepath.Clean(refs[i].path)
+			queue = append(queue, refs[i].path)
+		}
+
+		g.parents[path] = refs
+
+		if len(deps) > 0 {
+			g.deps[path] = deps
+		}
+
+		for _, dep := range deps {
+			if dep.via == "$import" {
+				queue = append(queue, dep.path)
+			}
+		}
+	}
+
+	return g
+}
+
+// scanLayer scans the file at path, recording it in g if it's a symlink, and
+// returns its parents and the files it reads.
+func (p *Parser) scanLayer(g *layerGraph, path string) ([]parentRef, []parentRef, error) {
+	f, err := p.scanFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deps, err := f.deps()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	refs, err := f.parents()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if f.link != "" {
+		g.targets[path] = filepath.Clean(f.path)
+	}
+
+	return refs, deps, nil
+}
+
+// err returns the error from the first file that couldn't be scanned, or
+// nil.
+func (g *layerGraph) err() error {
+	if len(g.errs) == 0 {
+		return nil
+	}
+
+	return g.errs[0]
+}
+
+// broken returns whether path, or any file it inherits from or reads,
+// couldn't be scanned. memo holds results for paths already checked.
+func (g *layerGraph) broken(path string, memo map[string]bool) bool {
+	if ret, found := memo[path]; found {
+		return ret
+	}
+
+	// Guard against loops, as in Affected
+	memo[path] = false
+
+	ret := g.failed[path]
+
+	if target, found := g.targets[path]; found && g.broken(target, memo) {
+		ret = true
+	}
+
+	for _, ref := range g.edges(path) {
+		if g.broken(ref.path, memo) {
+			ret = true
+		}
+	}
+
+	memo[path] = ret
+
+	return ret
+}
+
+// edges returns the parents of path followed by the files it reads.
+func (g *layerGraph) edges(path string) []parentRef {
+	return append(polyfill.SlicesClone(g.parents[path]), g.deps[path]...)
+}
+
+// files returns the scanned files and the files they read with $file (which
+// aren't scanned), in lexical order.
+func (g *layerGraph) files() []string {
+	ret := polyfill.MapsKeys(g.parents)
+
+	for _, deps := range g.deps {
+		for _, dep := range deps {
+			if _, found := g.parents[dep.path]; !found && !polyfill.SlicesContains(ret, dep.path) {
+				ret = append(ret, dep.path)
+			}
+		}
+	}
+
+	polyfill.SlicesSort(ret)
+
+	return ret
+}
+
+// leaves returns the files in the tree that aren't parents of, or read with
+// $import or $file by, any file.
+func (g *layerGraph) leaves() []string {
+	isParent := map[string]bool{}
+
+	for path := range g.parents {
+		for _, ref := range g.edges(path) {
+			isParent[ref.path] = true
+		}
+	}
+
+	ret := []string{}
+
+	for _, path := range g.paths {
+		if !isParent[path] {
+			ret = append(ret, path)
+		}
+	}
+
+	return ret
+}
+
+// comparablePath returns a form of path that is equal for equivalent paths.
+func (p *Parser) comparablePath(path string) string {
+	if p.fsys != nil {
+		return fsPath(path)
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+
+	return abs
+}
+
+// findFiles returns the paths of files with supported extensions in dir and
+// its subdirectories, in lexical order.
+func (p *Parser) findFiles(dir string) ([]string, error) {
+	ret := []string{}
+
+	root := dir
+	if p.fsys != nil {
+		root = fsPath(dir)
+	}
+
+	walk := func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path != root && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+
+			return nil
+		}
+
+		if d.IsDir() || !isFormat(ext(path)) {
+			return nil
+		}
+
+		ret = append(ret, filepath.Clean(path))
+
+		return nil
+	}
+
+	var err error
+
+	if p.fsys == nil {
+		err = filepath.WalkDir(root, walk)
+	} else {
+		err = fs.WalkDir(p.fsys, root, walk)
+	}
+
+	if err != nil {
+		return nil, polyfill.ErrorsJoin(fmt.Errorf("%s: %w", dir, ErrMissingFile), err)
+	}
+
+	polyfill.SlicesSort(ret)
+
+	return ret, nil
+}
+
+// scanFile loads the file at path for inspecting its parents. $env is not
+// resolved, so files can be scanned without their variables.
+func (p *Parser) scanFile(path string) (*file, error) {
+	fh, err := openFile(p.fsys, path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	defer fh.Close()
+
+	f := &file{
+		path: path,
+		fsys: p.fsys,
+	}
+
+	format, err := GetFormat(ext(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	raw, err := io.ReadAll(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	docs, err := parseDocs(format, raw, path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, doc := range docs {
+		f.docs = append(f.docs, NewDocumentWithData(doc.data))
+	}
+
+	return f, nil
+}
+
+// deps returns the files that f reads with $file and $import. Paths that
+// depend on $env aren't known without variables, so they're skipped.
+func (f *file) deps() ([]parentRef, error) {
+	ret := []parentRef{}
+
+	for _, doc := range f.docs {
+		for _, rel := range includePaths(doc.Data) {
+			path := filepath.Clean(filepath.Join(filepath.Dir(f.path), rel))
+			ret = append(ret, parentRef{path: path, via: "$file"})
+		}
+
+		val, found := doc.DataAsMap()["$import"]
+		if !found {
+			continue
+		}
+
+		paths, err := importPaths(val)
+		if err != nil {
+			return nil, withDirective(err, "$import")
+		}
+
+		names := polyfill.MapsKeys(paths)
+		polyfill.SlicesSort(names)
+
+		for _, name := range names {
+			refs, err := f.toAbsolutePaths([]string{paths[name]})
+			if err != nil {
+				return nil, err
+			}
+
+			for _, ref := range refs {
+				ret = append(ret, parentRef{path: filepath.Clean(ref.path), via: "$import"})
+			}
+		}
+	}
+
+	return ret, nil
+}
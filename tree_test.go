@@ -0,0 +1,55 @@
+package bkl_test
+
+import (
+	"testing"
+
+	"github.com/gopatchy/bkl"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaves(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	leaves, err := b.Leaves("tests/leaves/c")
+	require.NoError(t, err)
+	require.Equal(t, []string{"tests/leaves/c/a.b.yaml", "tests/leaves/c/sub/y.yaml", "tests/leaves/c/v/all.yaml"}, leaves)
+}
+
+func TestScanLeaves(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	leaves, errs, err := b.ScanLeaves("tests/leaves-errors/c")
+	require.NoError(t, err)
+	require.Equal(t, []string{"tests/leaves-errors/c/d.yaml", "tests/leaves-errors/c/g.h.i.yaml"}, leaves)
+	require.Len(t, errs, 3)
+	require.ErrorContains(t, errs[0], "tests/leaves-errors/c/a.yaml: yaml:")
+	require.ErrorIs(t, errs[1], bkl.ErrMissingFile)
+	require.ErrorIs(t, errs[2], bkl.ErrMissingFile)
+
+	_, err = b.Leaves("tests/leaves-errors/c")
+	require.ErrorContains(t, err, "tests/leaves-errors/c/a.yaml: yaml:")
+}
+
+func TestAffected(t *testing.T) {
+	t.Parallel()
+
+	b := bkl.New()
+
+	for _, tc := range []struct {
+		changed []string
+		want    []string
+	}{
+		{[]string{"tests/affected-parents/c/a.yaml"}, []string{"tests/affected-parents/c/a.b.c.yaml", "tests/affected-parents/c/d.yaml"}},
+		{[]string{"tests/affected-parents/shared/base.yaml", "./tests/affected-parents/c/e.yaml"}, []string{"tests/affected-parents/c/d.yaml", "tests/affected-parents/c/e.yaml"}},
+		{[]string{"tests/affected-parents/c/a.b.yaml"}, []string{"tests/affected-parents/c/a.b.c.yaml"}},
+		{[]string{"tests/affected-parents/other.yaml"}, []string{}},
+	} {
+		affected, err := b.Affected("tests/affected-parents/c", tc.changed...)
+		require.NoError(t, err, tc.changed)
+		require.Equal(t, tc.want, affected, tc.changed)
+	}
+}
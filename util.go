@@ -291,3 +291,28 @@ func toStringListPermissive(v any) ([]string, error) {
 
 	return ret, nil
 }
+
+func deepCopy(obj any) any {
+	switch obj2 := obj.(type) {
+	case map[string]any:
+		ret := make(map[string]any, len(obj2))
+
+		for k, v := range obj2 {
+			ret[k] = deepCopy(v)
+		}
+
+		return ret
+
+	case []any:
+		ret := make([]any, len(obj2))
+
+		for i, v := range obj2 {
+			ret[i] = deepCopy(v)
+		}
+
+		return ret
+
+	default:
+		return obj
+	}
+}
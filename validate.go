@@ -25,14 +25,14 @@ func validate(obj any) error {
 
 func validateMap(obj map[string]any) error {
 	for k, v := range obj {
-		err := validate(k)
+		err := validateKey(k)
 		if err != nil {
-			return fmt.Errorf("%s: %w", k, err)
+			return withKey(err, k)
 		}
 
 		err = validate(v)
 		if err != nil {
-			return fmt.Errorf("%s: %w", k, err)
+			return withKey(err, k)
 		}
 	}
 
@@ -40,10 +40,10 @@ func validateMap(obj map[string]any) error {
 }
 
 func validateList(obj []any) error {
-	for _, v := range obj {
+	for i, v := range obj {
 		err := validate(v)
 		if err != nil {
-			return err
+			return withIndex(err, i)
 		}
 	}
 
@@ -51,13 +51,25 @@ func validateList(obj []any) error {
 }
 
 func validateString(obj string) error {
+	if name, _, ok := stringDirectiveName(obj); ok {
+		if d, found := getDirective(name); found && d.String != nil {
+			return nil
+		}
+	}
+
+	return validateKey(obj)
+}
+
+// validateKey is like validateString, for map keys, where registered string
+// directives aren't run.
+func validateKey(obj string) error {
 	if obj == "$required" {
-		return ErrRequiredField
+		return withDirective(ErrRequiredField, obj)
 	}
 
 	us := utf8string.NewString(obj)
 	if us.RuneCount() >= 2 && us.At(0) == '$' && unicode.IsLower(us.At(1)) {
-		return fmt.Errorf("%s: %w", obj, ErrInvalidDirective)
+		return withDirective(fmt.Errorf("%s: %w", obj, ErrInvalidDirective), obj)
 	}
 
 	return nil
@@ -2,7 +2,12 @@ package bkl
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
 	"regexp"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -37,25 +42,146 @@ func yamlMarshalStream(vs []any) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-var yamlRE = regexp.MustCompile(`(?m)^---$`)
+// yamlVersionRE matches %YAML directives. yaml.v3 rejects versions other
+// than 1.1, but parses 1.2 documents.
+var yamlVersionRE = regexp.MustCompile(`(?m)^%YAML[ \t]+1\.[0-9]+`)
 
 func yamlUnmarshalStream(in []byte) ([]any, error) {
-	// Differs from repeated yaml.Decode by treating "---\n---" as an empty
-	// document rather than skipping it.
+	docs, _, err := yamlUnmarshalStreamPositions(in)
+	return docs, err
+}
+
+func yamlUnmarshalStreamPositions(in []byte) ([]any, []positions, error) {
+	docs, poss, _, err := yamlUnmarshalStreamComments(in)
+	return docs, poss, err
+}
+
+func yamlUnmarshalStreamComments(in []byte) ([]any, []positions, []comments, error) {
+	// Differs from repeated yaml.Unmarshal by treating "---\n---" as an empty
+	// document rather than skipping it, and an empty stream as one empty
+	// document.
 
-	parts := yamlRE.Split(string(in), -1)
 	ret := []any{}
+	poss := []positions{}
+	cmts := []comments{}
+	dec := yaml.NewDecoder(bytes.NewReader(yamlVersionRE.ReplaceAll(in, []byte("%YAML 1.1"))))
+
+	for {
+		var node yaml.Node
+
+		err := dec.Decode(&node)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, nil, nil, err
+		}
 
-	for _, s := range parts {
 		var obj any
 
-		err := yaml.Unmarshal([]byte(s), &obj)
+		err = node.Decode(&obj)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
 
+		obj = yamlTimes(&node, obj)
+
+		ps := positions{}
+		yamlPositions(&node, "", ps)
+
+		cs := comments{}
+		yamlComments(&node, "", cs)
+
 		ret = append(ret, obj)
+		poss = append(poss, ps)
+		cmts = append(cmts, cs)
+	}
+
+	if len(ret) == 0 {
+		return []any{nil}, []positions{{}}, []comments{{}}, nil
+	}
+
+	return ret, poss, cmts, nil
+}
+
+func yamlPositions(node *yaml.Node, path string, ps positions) {
+	switch node.Kind { //nolint:exhaustive
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			yamlPositions(child, path, ps)
+		}
+
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			k, v := node.Content[i], node.Content[i+1]
+			subPath := keyPath(path, k.Value)
+
+			ps.add(subPath, Position{Line: k.Line, Column: k.Column})
+			yamlPositions(v, subPath, ps)
+		}
+
+	case yaml.SequenceNode:
+		for i, v := range node.Content {
+			subPath := indexPath(path, i)
+
+			ps.add(subPath, Position{Line: v.Line, Column: v.Column})
+			yamlPositions(v, subPath, ps)
+		}
+	}
+}
+
+// yamlTimes replaces the timestamps decoded from node into obj with
+// DateTimes, keeping whether each had a time, which decoding to time.Time
+// loses. Timestamps with a time but no zone are in UTC. Timestamps that can't be reparsed (e.g. those reached
+// through aliases) are left for normalize. Integers too large for uint64,
+// which yaml.v3 decodes to float64, are replaced with json.Number so that
+// normalize rejects them.
+func yamlTimes(node *yaml.Node, obj any) any {
+	switch node.Kind { //nolint:exhaustive
+	case yaml.DocumentNode:
+		if len(node.Content) == 1 {
+			return yamlTimes(node.Content[0], obj)
+		}
+
+	case yaml.MappingNode:
+		objMap, ok := obj.(map[string]any)
+		if !ok {
+			return obj
+		}
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			k, v := node.Content[i], node.Content[i+1]
+
+			if val, found := objMap[k.Value]; found {
+				objMap[k.Value] = yamlTimes(v, val)
+			}
+		}
+
+	case yaml.SequenceNode:
+		objList, ok := obj.([]any)
+		if !ok || len(objList) != len(node.Content) {
+			return obj
+		}
+
+		for i, v := range node.Content {
+			objList[i] = yamlTimes(v, objList[i])
+		}
+
+	case yaml.ScalarNode:
+		switch obj.(type) {
+		case float64:
+			if _, ok := new(big.Int).SetString(node.Value, 10); ok {
+				return json.Number(node.Value)
+			}
+
+		case time.Time:
+			dt, err := parseDateTime(node.Value)
+			if err == nil {
+				// YAML timestamps without a zone are in UTC
+				dt.HasZone = dt.HasTime
+				return dt
+			}
+		}
 	}
 
-	return ret, nil
+	return obj
 }